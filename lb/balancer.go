@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A Balancer decides which instance a request is sent to. Implementations must
+// be safe for concurrent use
+type Balancer interface {
+	// Pick chooses one of `instances` to serve `req`. It returns nil if none of them
+	// can serve it. `req` may be nil when the caller has no request at hand
+	Pick(instances []*Instance, req *http.Request) *Instance
+	// Observe is called with the outcome of every request proxied to an instance.
+	// `err` is non nil if the instance could not be reached
+	Observe(ins *Instance, duration time.Duration, err error)
+	// Add and Remove are called when instances join or leave the LB
+	Add(ins *Instance)
+	Remove(ins *Instance)
+}
+
+const DEFAULT_BALANCER = "roundrobin"
+const WEIGHTED_BALANCER = "weighted"
+const LEAST_CONN_BALANCER = "leastconn"
+const P2C_BALANCER = "p2c"
+const HASH_BALANCER = "hash"
+
+// Returns the balancer registered under `cfg.Balancer`
+func NewBalancer(cfg Config) (Balancer, error) {
+	switch cfg.Balancer {
+	case "", DEFAULT_BALANCER:
+		return &roundRobin{}, nil
+	case LEAST_CONN_BALANCER:
+		return &leastOutstanding{}, nil
+	case P2C_BALANCER:
+		return &powerOfTwoChoices{latencies: map[*Instance]*ewma{}}, nil
+	case WEIGHTED_BALANCER:
+		return &weightedRoundRobin{currentWeights: map[*Instance]float64{}}, nil
+	case HASH_BALANCER:
+		key, err := parseHashKey(cfg.HashKey)
+		if err != nil {
+			return nil, fmt.Errorf("[NewBalancer] -> %s", err.Error())
+		}
+		return &consistentHash{key: key}, nil
+	default:
+		return nil, fmt.Errorf("[NewBalancer] -> unknown balancer: `%s`", cfg.Balancer)
+	}
+}
+
+// Round Robin - kinda!
+// Instances are tried in order starting after the last one picked and the first
+// available one is used
+type roundRobin struct {
+	mx      sync.Mutex
+	current int
+}
+
+func (rr *roundRobin) Pick(instances []*Instance, _ *http.Request) *Instance {
+	rr.mx.Lock()
+	defer rr.mx.Unlock()
+
+	n := len(instances)
+	checked := 0
+
+	// This should never happen but oh well
+	if n == 0 {
+		return nil
+	}
+
+	// Start looking at available nodes from 1 + the last node used
+	// Increment by 1 until a node is found or we have checked all listed nodes
+	index := rr.current + 1
+	if index >= n {
+		index = 0
+	}
+	for checked < n {
+		checked += 1
+		if instances[index].isAvailable() {
+			rr.current = index
+			return instances[index]
+		}
+		index += 1
+		if index >= n {
+			index = 0
+		}
+	}
+
+	// Return empty if no available node was found
+	return nil
+}
+
+func (rr *roundRobin) Observe(*Instance, time.Duration, error) {}
+
+func (rr *roundRobin) Add(*Instance) {}
+
+func (rr *roundRobin) Remove(*Instance) {}
+
+// Smooth weighted round robin - the one nginx uses.
+// Every pick each available instance's current weight grows by its weight, the
+// instance with the highest current weight is chosen and has its current weight
+// reduced by the sum of all weights. This spreads heavier instances evenly
+// instead of sending them bursts of consecutive requests.
+// Instances in slow start take part with their reduced weight
+type weightedRoundRobin struct {
+	mx             sync.Mutex
+	currentWeights map[*Instance]float64
+}
+
+func (wrr *weightedRoundRobin) handlesSlowStart() {}
+
+func (wrr *weightedRoundRobin) Pick(instances []*Instance, _ *http.Request) *Instance {
+	wrr.mx.Lock()
+	defer wrr.mx.Unlock()
+
+	var best *Instance
+	total := 0.0
+	now := time.Now()
+	for _, ins := range instances {
+		if !ins.isAvailable() {
+			continue
+		}
+		weight := ins.effectiveWeight(now)
+		wrr.currentWeights[ins] += weight
+		total += weight
+		if best == nil || wrr.currentWeights[ins] > wrr.currentWeights[best] {
+			best = ins
+		}
+	}
+
+	if best != nil {
+		wrr.currentWeights[best] -= total
+	}
+	return best
+}
+
+func (wrr *weightedRoundRobin) Observe(*Instance, time.Duration, error) {}
+
+func (wrr *weightedRoundRobin) Add(*Instance) {}
+
+func (wrr *weightedRoundRobin) Remove(ins *Instance) {
+	wrr.mx.Lock()
+	defer wrr.mx.Unlock()
+	delete(wrr.currentWeights, ins)
+}
+
+// Least outstanding requests.
+// The available instance with the fewest requests in flight is chosen. Ties are
+// broken round robin by starting the scan one position further every pick
+type leastOutstanding struct {
+	mx    sync.Mutex
+	start int
+}
+
+func (lo *leastOutstanding) Pick(instances []*Instance, _ *http.Request) *Instance {
+	lo.mx.Lock()
+	defer lo.mx.Unlock()
+
+	n := len(instances)
+	if n == 0 {
+		return nil
+	}
+
+	var best *Instance
+	var bestInFlight int64
+	bestIndex := 0
+	for i := range n {
+		index := (lo.start + i) % n
+		ins := instances[index]
+		if !ins.isAvailable() {
+			continue
+		}
+		inFlight := ins.inFlight.Load()
+		if best == nil || inFlight < bestInFlight {
+			best = ins
+			bestInFlight = inFlight
+			bestIndex = index
+		}
+	}
+
+	if best != nil {
+		lo.start = bestIndex + 1
+	}
+	return best
+}
+
+func (lo *leastOutstanding) Observe(*Instance, time.Duration, error) {}
+
+func (lo *leastOutstanding) Add(*Instance) {}
+
+func (lo *leastOutstanding) Remove(*Instance) {}
+
+// Exponentially weighted moving average of response times. Older samples decay
+// with time rather than with the number of samples so an instance that is no
+// longer being called does not stay stuck with a bad score
+type ewma struct {
+	value     float64 // nanoseconds
+	updatedAt time.Time
+}
+
+const EWMA_DECAY = time.Second * 10
+
+// Response time recorded for requests that failed to reach the instance
+const EWMA_FAILURE_PENALTY = time.Second
+
+func (e *ewma) observe(duration time.Duration, now time.Time) {
+	if e.updatedAt.IsZero() {
+		e.value = float64(duration)
+		e.updatedAt = now
+		return
+	}
+	w := math.Exp(-float64(now.Sub(e.updatedAt)) / float64(EWMA_DECAY))
+	e.value = e.value*w + float64(duration)*(1-w)
+	e.updatedAt = now
+}
+
+// Value of the average at `now`. While no samples come in it decays towards
+// that of an instance that was never observed, so that an instance that lost
+// every comparison gets picked again eventually and can show it has recovered
+func (e *ewma) at(now time.Time) float64 {
+	return e.value * math.Exp(-float64(now.Sub(e.updatedAt))/float64(EWMA_DECAY))
+}
+
+// Power of two choices.
+// Two distinct healthy instances are sampled at random and the one with the
+// lower EWMA response time x (requests in flight + 1) is chosen. Unlike the other
+// balancers slow instances are not cut off at a fixed response time - they just
+// receive proportionally less traffic
+type powerOfTwoChoices struct {
+	mx        sync.Mutex
+	latencies map[*Instance]*ewma
+}
+
+// Must be called with p2c.mx held
+func (p2c *powerOfTwoChoices) score(ins *Instance, now time.Time) float64 {
+	latency := 0.0
+	if e, ok := p2c.latencies[ins]; ok {
+		latency = e.at(now)
+	}
+	return latency * float64(ins.inFlight.Load()+1)
+}
+
+func (p2c *powerOfTwoChoices) Pick(instances []*Instance, _ *http.Request) *Instance {
+	healthy := make([]*Instance, 0, len(instances))
+	for _, ins := range instances {
+		if ins.isHealthy() {
+			healthy = append(healthy, ins)
+		}
+	}
+
+	switch len(healthy) {
+	case 0:
+		return nil
+	case 1:
+		return healthy[0]
+	}
+
+	i := rand.IntN(len(healthy))
+	j := rand.IntN(len(healthy) - 1)
+	if j >= i {
+		j += 1
+	}
+	a, b := healthy[i], healthy[j]
+
+	p2c.mx.Lock()
+	defer p2c.mx.Unlock()
+	now := time.Now()
+	if p2c.score(b, now) < p2c.score(a, now) {
+		return b
+	}
+	return a
+}
+
+func (p2c *powerOfTwoChoices) Observe(ins *Instance, duration time.Duration, err error) {
+	if err != nil {
+		duration = max(duration, EWMA_FAILURE_PENALTY)
+	}
+
+	p2c.mx.Lock()
+	defer p2c.mx.Unlock()
+	e, ok := p2c.latencies[ins]
+	if !ok {
+		e = &ewma{}
+		p2c.latencies[ins] = e
+	}
+	e.observe(duration, time.Now())
+}
+
+func (p2c *powerOfTwoChoices) Add(*Instance) {}
+
+func (p2c *powerOfTwoChoices) Remove(ins *Instance) {
+	p2c.mx.Lock()
+	defer p2c.mx.Unlock()
+	delete(p2c.latencies, ins)
+}
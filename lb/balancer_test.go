@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Picks the last instance it was handed and records every call
+type recordingBalancer struct {
+	added    []*Instance
+	removed  []*Instance
+	observed []*Instance
+}
+
+func (b *recordingBalancer) Pick(instances []*Instance, _ *http.Request) *Instance {
+	if len(instances) == 0 {
+		return nil
+	}
+	return instances[len(instances)-1]
+}
+
+func (b *recordingBalancer) Observe(ins *Instance, _ time.Duration, _ error) {
+	b.observed = append(b.observed, ins)
+}
+
+func (b *recordingBalancer) Add(ins *Instance) {
+	b.added = append(b.added, ins)
+}
+
+func (b *recordingBalancer) Remove(ins *Instance) {
+	b.removed = append(b.removed, ins)
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, name := range []string{"", "roundrobin"} {
+		b, err := NewBalancer(Config{Balancer: name})
+		if err != nil {
+			t.Errorf("NewBalancer(`%s`) should not error: %s\n", name, err)
+		}
+		if _, ok := b.(*roundRobin); !ok {
+			t.Errorf("NewBalancer(`%s`) should return the round robin balancer\n", name)
+		}
+	}
+
+	_, err := NewBalancer(Config{Balancer: "nope"})
+	if err == nil {
+		t.Fatal("NewBalancer should error for an unknown balancer")
+	}
+	if !strings.HasPrefix(err.Error(), "[NewBalancer] -> unknown balancer: ") {
+		t.Error("Wrong error detected or error string has changed")
+	}
+
+	_, err = NewLBWithConfig(t.Context(), Config{Balancer: "nope"})
+	if err == nil {
+		t.Error("NewLBWithConfig should error for an unknown balancer")
+	}
+}
+
+func TestLBDelegatesToBalancer(t *testing.T) {
+	balancer := &recordingBalancer{}
+	lb := &LB{Ctx: t.Context(), balancer: balancer}
+
+	if err := lb.AddInstance("http://localhost:20000"); err != nil {
+		t.Fatal("AddInstance should not error here: ", err)
+	}
+	if err := lb.AddInstance("http://localhost:20001"); err != nil {
+		t.Fatal("AddInstance should not error here: ", err)
+	}
+	if len(balancer.added) != 2 {
+		t.Errorf("balancer should have been told about 2 instances. Actual: %d\n", len(balancer.added))
+	}
+
+	ins := lb.GetInstance()
+	if ins == nil || ins.url != "http://localhost:20001" {
+		t.Error("GetInstance should return whatever the balancer picks")
+	}
+
+	lb.Observe(ins, http.StatusOK, time.Millisecond, nil)
+	if len(balancer.observed) != 1 || balancer.observed[0] != ins {
+		t.Error("Observe was not passed on to the balancer")
+	}
+
+	// Requests abandoned by the client say nothing about the instance
+	lb.Observe(ins, 0, time.Millisecond, context.Canceled)
+	lb.Observe(ins, 0, time.Millisecond, fmt.Errorf("[Instance.roundTrip] -> %w", context.DeadlineExceeded))
+	if len(balancer.observed) != 1 {
+		t.Error("cancelled requests should not be passed on to the balancer")
+	}
+
+	lb.RemoveInstance("http://localhost:20001")
+	if len(balancer.removed) != 1 || balancer.removed[0] != ins {
+		t.Error("balancer should have been told about the removed instance")
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	balancer, err := NewBalancer(Config{Balancer: "weighted"})
+	if err != nil {
+		t.Fatal("NewBalancer should not error here: ", err)
+	}
+
+	a := &Instance{url: "a", weight: 5, healthy: true}
+	b := &Instance{url: "b", weight: 1, healthy: true}
+	c := &Instance{url: "c", weight: 1, healthy: true}
+	instances := []*Instance{a, b, c}
+
+	// nginx's smooth weighted round robin sequence for weights 5, 1, 1
+	expected := "aabacaa"
+	actual := ""
+	for range 2 {
+		actual = ""
+		for range 7 {
+			actual += balancer.Pick(instances, nil).url
+		}
+		if actual != expected {
+			t.Errorf("Expected: `%s`, Actual: `%s`\n", expected, actual)
+		}
+	}
+
+	// Unavailable instances are skipped and share is spread among the rest
+	a.healthy = false
+	counts := map[string]int{}
+	for range 10 {
+		counts[balancer.Pick(instances, nil).url] += 1
+	}
+	if counts["a"] != 0 || counts["b"] != 5 || counts["c"] != 5 {
+		t.Error("unavailable instance should be skipped. Actual: ", counts)
+	}
+
+	b.healthy = false
+	c.healthy = false
+	if balancer.Pick(instances, nil) != nil {
+		t.Error("nil should be returned when no instance is available")
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	balancer, err := NewBalancer(Config{Balancer: "leastconn"})
+	if err != nil {
+		t.Fatal("NewBalancer should not error here: ", err)
+	}
+
+	a := &Instance{url: "a", healthy: true}
+	b := &Instance{url: "b", healthy: true}
+	c := &Instance{url: "c", healthy: true}
+	instances := []*Instance{a, b, c}
+
+	// All idle - ties are broken round robin
+	actual := ""
+	for range 6 {
+		actual += balancer.Pick(instances, nil).url
+	}
+	if actual != "abcabc" {
+		t.Errorf("ties should be broken round robin. Expected: `abcabc`, Actual: `%s`\n", actual)
+	}
+
+	a.inFlight.Store(3)
+	b.inFlight.Store(1)
+	c.inFlight.Store(2)
+	if ins := balancer.Pick(instances, nil); ins != b {
+		t.Errorf("instance with fewest requests in flight should be picked. Expected: `b`, Actual: `%s`\n", ins.url)
+	}
+
+	b.healthy = false
+	if ins := balancer.Pick(instances, nil); ins != c {
+		t.Errorf("unavailable instance should be skipped. Expected: `c`, Actual: `%s`\n", ins.url)
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	now := time.Now()
+	e := &ewma{}
+	e.observe(time.Millisecond*10, now)
+	if e.value != float64(time.Millisecond*10) {
+		t.Errorf("first sample should be taken as is. Actual: %v\n", e.value)
+	}
+
+	// After one decay period the old value keeps a weight of 1/e
+	e.observe(0, now.Add(EWMA_DECAY))
+	expected := float64(time.Millisecond*10) / math.E
+	if math.Abs(e.value-expected) > 1 {
+		t.Errorf("Expected: %v, Actual: %v\n", expected, e.value)
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	balancer, err := NewBalancer(Config{Balancer: "p2c"})
+	if err != nil {
+		t.Fatal("NewBalancer should not error here: ", err)
+	}
+
+	fast := &Instance{url: "fast", healthy: true}
+	medium := &Instance{url: "medium", healthy: true}
+	// Too slow for the other balancers
+	slow := &Instance{url: "slow", healthy: true, latency: newLatencySketch(time.Second * 10), latencyPolicy: defaultLatencyPolicy()}
+	slow.latency.record(time.Now(), time.Millisecond*50)
+	down := &Instance{url: "down"}
+	instances := []*Instance{fast, medium, slow, down}
+
+	balancer.Observe(fast, time.Millisecond, nil)
+	balancer.Observe(medium, time.Millisecond*5, nil)
+	balancer.Observe(slow, time.Millisecond*50, nil)
+
+	counts := map[string]int{}
+	for range 300 {
+		counts[balancer.Pick(instances, nil).url] += 1
+	}
+	if counts["down"] != 0 {
+		t.Error("unhealthy instances should never be picked: ", counts)
+	}
+	if counts["slow"] >= counts["medium"] {
+		t.Error("slowest instance should be picked least: ", counts)
+	}
+	if counts["fast"] <= counts["medium"] || counts["medium"] == 0 {
+		t.Error("fast should be picked more often than medium and medium should still be used: ", counts)
+	}
+
+	// Requests in flight scale the score
+	fast.inFlight.Store(100)
+	counts = map[string]int{}
+	for range 300 {
+		counts[balancer.Pick([]*Instance{fast, medium}, nil).url] += 1
+	}
+	if counts["fast"] != 0 {
+		t.Error("busy instance should lose to the idle one: ", counts)
+	}
+
+	// Instances above the 10ms cliff are still used when they are the only one
+	if ins := balancer.Pick([]*Instance{slow, down}, nil); ins != slow {
+		t.Error("the only healthy instance should be picked regardless of its response time")
+	}
+
+	balancer.Observe(medium, time.Millisecond, fmt.Errorf("connection refused"))
+	p2c := balancer.(*powerOfTwoChoices)
+	if p2c.latencies[medium].value < float64(time.Millisecond*5) {
+		t.Error("failures should push the response time average up")
+	}
+}
+
+func TestPowerOfTwoChoicesRecovery(t *testing.T) {
+	balancer, _ := NewBalancer(Config{Balancer: "p2c"})
+	p2c := balancer.(*powerOfTwoChoices)
+	ok := &Instance{url: "ok", healthy: true}
+	failed := &Instance{url: "failed", healthy: true}
+	instances := []*Instance{ok, failed}
+
+	balancer.Observe(ok, time.Millisecond, nil)
+	balancer.Observe(failed, time.Millisecond, fmt.Errorf("connection refused"))
+	for range 100 {
+		if balancer.Pick(instances, nil) != ok {
+			t.Fatal("instance that just failed should lose to the one that didn't")
+		}
+	}
+
+	// Without new samples the penalty wears off and the instance gets traffic
+	// again, rather than losing every comparison forever
+	p2c.latencies[failed].updatedAt = time.Now().Add(-EWMA_DECAY * 12)
+	counts := map[string]int{}
+	for range 100 {
+		counts[balancer.Pick(instances, nil).url] += 1
+	}
+	if counts["failed"] == 0 {
+		t.Error("penalised instance should be picked again after a while: ", counts)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// Returned by readers of a replayBody that have been replaced by a newer one
+var errBodyReplaced = errors.New("request body is being read by a newer attempt")
+
+// Returned by readers of a replayBody that is no longer recorded
+var errBodyNotReplayable = errors.New("request body can't be sent again")
+
+// A request body that is streamed to the instance as it arrives and recorded
+// on the way, so that it can be sent again - for retries and the like - without
+// waiting for the client to finish sending it first.
+// Small bodies are recorded in memory, larger ones are spilled to a temporary
+// file. Bodies larger than `maxSize` are passed on all the same but are no
+// longer recorded, and so can't be sent again
+type replayBody struct {
+	mx         sync.Mutex
+	srcMx      sync.Mutex // Held while reading `src`, which b.mx is not
+	src        io.Reader  // Nil once read to the end
+	memLimit   int64
+	maxSize    int64
+	tempDir    string
+	mem        []byte
+	file       *os.File
+	size       int64 // Bytes recorded so far
+	err        error // Error reading `src`
+	generation int   // Only the latest reader may read
+	stopped    bool  // No longer recorded. See stopRecording
+	closed     bool
+}
+
+func newReplayBody(body io.Reader, memLimit, maxSize int64, tempDir string) *replayBody {
+	b := &replayBody{src: body, memLimit: memLimit, maxSize: maxSize, tempDir: tempDir}
+	if body == http.NoBody {
+		b.src = nil
+	}
+	return b
+}
+
+// Returns a new reader from the start of the body. It replays what has been
+// recorded so far and then continues with the rest of the body as it arrives.
+// Readers returned earlier stop working - a transport may still be reading a
+// request body after its attempt has been given up on
+func (b *replayBody) Reader() io.ReadCloser {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.src == nil && b.size == 0 && b.err == nil {
+		return http.NoBody
+	}
+	if b.stopped {
+		return failedReader{errBodyNotReplayable}
+	}
+	b.generation += 1
+	return &replayReader{body: b, generation: b.generation}
+}
+
+// Error that reading the body from the client ended with, if any
+func (b *replayBody) Err() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.err
+}
+
+// Whether the body can still be sent again from the start
+func (b *replayBody) Replayable() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return !b.stopped
+}
+
+// Stops recording the rest of the body as it arrives - once it will not be
+// sent again. The reader it is being read through keeps working
+func (b *replayBody) stopRecording() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.stopped = true
+}
+
+// Records `p` after what has been read so far
+// Must be called with b.mx held
+func (b *replayBody) record(p []byte) error {
+	if b.stopped {
+		return nil
+	}
+	if b.size+int64(len(p)) > b.maxSize {
+		// Too large to keep. The reader that got this far is the only one
+		// that will ever read the body, so what was recorded goes as well
+		b.stopped = true
+		b.discard()
+		return nil
+	}
+	if b.file == nil && b.size+int64(len(p)) > b.memLimit {
+		file, err := os.CreateTemp(b.tempDir, "lb-body-*")
+		if err != nil {
+			return fmt.Errorf("[replayBody.record] -> error creating temp file: %w", err)
+		}
+		b.file = file
+		if _, err := b.file.Write(b.mem); err != nil {
+			return fmt.Errorf("[replayBody.record] -> error spilling body to disk: %w", err)
+		}
+		b.mem = nil
+	}
+	if b.file != nil {
+		if _, err := b.file.Write(p); err != nil {
+			return fmt.Errorf("[replayBody.record] -> error spilling body to disk: %w", err)
+		}
+	} else {
+		b.mem = append(b.mem, p...)
+	}
+	b.size += int64(len(p))
+	return nil
+}
+
+// Releases the body along with what has been recorded
+func (b *replayBody) Close() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.generation += 1
+	b.closed = true
+	return b.discard()
+}
+
+// Drops what has been recorded. Spilled bodies have their temporary file removed
+// Must be called with b.mx held
+func (b *replayBody) discard() error {
+	b.mem = nil
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+	return err
+}
+
+// Reader that fails every read with `err`
+type failedReader struct {
+	err error
+}
+
+func (r failedReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func (r failedReader) Close() error {
+	return nil
+}
+
+type replayReader struct {
+	body       *replayBody
+	generation int
+	offset     int64
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	b := r.body
+	b.mx.Lock()
+	if n, ok, err := r.replay(p); ok {
+		b.mx.Unlock()
+		return n, err
+	}
+	b.mx.Unlock()
+
+	// Waiting on the client must not hold up Err() - or the response of a
+	// full duplex request could never be relayed while its body is still open
+	b.srcMx.Lock()
+	defer b.srcMx.Unlock()
+	b.mx.Lock()
+	// An earlier reader may have read more in the meantime
+	if n, ok, err := r.replay(p); ok {
+		b.mx.Unlock()
+		return n, err
+	}
+	src := b.src
+	b.mx.Unlock()
+
+	// Continue with the rest of the body as it arrives
+	n, err := src.Read(p)
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return 0, errBodyReplaced
+	}
+	if n > 0 {
+		if recErr := b.record(p[:n]); recErr != nil {
+			b.err = recErr
+			return 0, recErr
+		}
+		r.offset += int64(n)
+	}
+	if err == io.EOF {
+		b.src = nil
+	} else if err != nil {
+		b.err = fmt.Errorf("[replayReader.Read] -> error reading body: %w", err)
+		return n, b.err
+	}
+	if r.generation != b.generation {
+		// Recorded all the same, for the reader that replaced this one
+		return 0, errBodyReplaced
+	}
+	return n, err
+}
+
+// Serves `p` from what has been recorded, if there is no need to read from
+// the client. Must be called with b.mx held
+func (r *replayReader) replay(p []byte) (int, bool, error) {
+	b := r.body
+	if r.generation != b.generation {
+		return 0, true, errBodyReplaced
+	}
+	if len(p) == 0 {
+		return 0, true, nil
+	}
+
+	// Replay what has been recorded
+	if r.offset < b.size {
+		var n int
+		var err error
+		if b.file != nil {
+			n, err = b.file.ReadAt(p[:min(int64(len(p)), b.size-r.offset)], r.offset)
+		} else {
+			n = copy(p, b.mem[r.offset:])
+		}
+		r.offset += int64(n)
+		if err != nil && err != io.EOF {
+			return n, true, fmt.Errorf("[replayReader.Read] -> error reading spilled body: %w", err)
+		}
+		return n, true, nil
+	}
+
+	if b.err != nil {
+		return 0, true, b.err
+	}
+	if b.src == nil {
+		return 0, true, io.EOF
+	}
+	return 0, false, nil
+}
+
+func (r *replayReader) Close() error {
+	return nil
+}
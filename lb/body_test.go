@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReplayBodyInMemory(t *testing.T) {
+	body := newReplayBody(strings.NewReader("hello"), 10, 100, t.TempDir())
+	defer body.Close()
+
+	for range 3 {
+		bs, _ := io.ReadAll(body.Reader())
+		if string(bs) != "hello" {
+			t.Errorf("every reader should return the whole body. Actual: `%s`\n", bs)
+		}
+	}
+	if body.file != nil {
+		t.Error("small body should have been kept in memory")
+	}
+}
+
+func TestReplayBodyResumesPartialReads(t *testing.T) {
+	body := newReplayBody(strings.NewReader("hello world"), 10, 100, t.TempDir())
+	defer body.Close()
+
+	// A first attempt that only got part of the body through
+	first := body.Reader()
+	buf := make([]byte, 5)
+	io.ReadFull(first, buf)
+
+	second := body.Reader()
+	if _, err := first.Read(buf); !errors.Is(err, errBodyReplaced) {
+		t.Error("replaced reader should stop working. Actual: ", err)
+	}
+	bs, _ := io.ReadAll(second)
+	if string(bs) != "hello world" {
+		t.Errorf("new reader should replay the start and continue with the rest. Actual: `%s`\n", bs)
+	}
+}
+
+func TestReplayBodySpillsToDisk(t *testing.T) {
+	dir := t.TempDir()
+	payload := make([]byte, 4096)
+	rand.Read(payload)
+
+	body := newReplayBody(bytes.NewReader(payload), 1024, 8192, dir)
+	for range 2 {
+		bs, err := io.ReadAll(body.Reader())
+		if err != nil {
+			t.Fatal("reading the body should not error here: ", err)
+		}
+		if !bytes.Equal(bs, payload) {
+			t.Error("spilled body does not match the original payload")
+		}
+	}
+	if body.file == nil {
+		t.Fatal("body larger than the memory limit should have been spilled to disk")
+	}
+
+	body.Close()
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Error("temporary file should have been removed on Close")
+	}
+}
+
+func TestReplayBodyTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	for _, memLimit := range []int64{1024, 10} { // In memory and spilled to disk
+		payload := make([]byte, 5000)
+		rand.Read(payload)
+		body := newReplayBody(bytes.NewReader(payload), memLimit, 4096, dir)
+		bs, err := io.ReadAll(body.Reader())
+		if err != nil || !bytes.Equal(bs, payload) {
+			t.Errorf("body larger than the max size should be passed on all the same. Read %d bytes, err: %v\n", len(bs), err)
+		}
+		if body.Replayable() || body.Err() != nil {
+			t.Error("body larger than the max size should no longer be replayable. Err: ", body.Err())
+		}
+		if _, err := body.Reader().Read(make([]byte, 10)); !errors.Is(err, errBodyNotReplayable) {
+			t.Error("reader of a body that is no longer recorded should fail. Actual: ", err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Error("temporary file of a body that is no longer recorded should have been removed")
+		}
+		body.Close()
+	}
+}
+
+func TestReplayBodyStopRecording(t *testing.T) {
+	body := newReplayBody(strings.NewReader("hello world"), 10, 100, t.TempDir())
+	defer body.Close()
+
+	reader := body.Reader()
+	buf := make([]byte, 5)
+	io.ReadFull(reader, buf)
+	body.stopRecording()
+	rest, _ := io.ReadAll(reader)
+	if string(buf)+string(rest) != "hello world" {
+		t.Errorf("reader should keep working once recording stopped. Actual: `%s%s`\n", buf, rest)
+	}
+	if body.size != 5 || body.Replayable() {
+		t.Errorf("nothing should be recorded once recording stopped. Recorded: %d\n", body.size)
+	}
+}
+
+func TestReplayBodyEmpty(t *testing.T) {
+	body := newReplayBody(nil, 10, 100, t.TempDir())
+	bs, _ := io.ReadAll(body.Reader())
+	if len(bs) != 0 {
+		t.Error("empty body should read nothing")
+	}
+}
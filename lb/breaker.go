@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// Number of buckets the error rate window is split into
+const BREAKER_BUCKETS = 10
+
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// Circuit breaker driven by the outcome of proxied requests.
+//   - closed: requests flow. Trips open after `consecutiveFailures` failures in a
+//     row or when at least `minRequests` were made within `window` and
+//     `errorRate` of them failed
+//   - open: no requests are sent for `openDuration`, after which it turns half-open
+//   - half-open: `halfOpenRequests` trial requests are let through. If all of them
+//     succeed it closes, a single failure opens it again
+type circuitBreaker struct {
+	mx                  sync.Mutex
+	consecutiveFailures int
+	errorRate           float64
+	minRequests         int
+	window              time.Duration
+	openDuration        time.Duration
+	halfOpenRequests    int
+
+	state     breakerState
+	failures  int // Consecutive failures
+	buckets   [BREAKER_BUCKETS]breakerBucket
+	openedAt  time.Time
+	trials    int // Trial requests let through while half-open
+	successes int // Trial requests that succeeded
+	// Called with every state change
+	onStateChange func(breakerState)
+}
+
+func newCircuitBreaker(cfg Config, onStateChange func(breakerState)) *circuitBreaker {
+	return &circuitBreaker{
+		consecutiveFailures: cfg.BreakerConsecutiveFailures,
+		errorRate:           cfg.BreakerErrorRate,
+		minRequests:         cfg.BreakerMinRequests,
+		window:              cfg.BreakerWindow,
+		openDuration:        cfg.BreakerOpenDuration,
+		halfOpenRequests:    cfg.BreakerHalfOpenRequests,
+		onStateChange:       onStateChange,
+	}
+}
+
+// Must be called with cb.mx held
+func (cb *circuitBreaker) setState(state breakerState, now time.Time) {
+	if cb.state == state {
+		return
+	}
+	cb.state = state
+	cb.failures = 0
+	cb.trials = 0
+	cb.successes = 0
+	cb.buckets = [BREAKER_BUCKETS]breakerBucket{}
+	if state == breakerOpen {
+		cb.openedAt = now
+	}
+	if cb.onStateChange != nil {
+		cb.onStateChange(state)
+	}
+}
+
+// Open breakers turn half-open once openDuration has passed.
+// Must be called with cb.mx held
+func (cb *circuitBreaker) refresh(now time.Time) {
+	if cb.state == breakerOpen && now.Sub(cb.openedAt) >= cb.openDuration {
+		cb.setState(breakerHalfOpen, now)
+	}
+}
+
+func (cb *circuitBreaker) State(now time.Time) breakerState {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	cb.refresh(now)
+	return cb.state
+}
+
+// Reports whether a request could be let through right now without reserving it
+func (cb *circuitBreaker) ready(now time.Time) bool {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	cb.refresh(now)
+
+	switch cb.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return cb.trials < cb.halfOpenRequests
+	}
+	return true
+}
+
+// Lets a request through if the breaker allows it. While half-open every
+// request allowed takes up one of the trial slots
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	cb.refresh(now)
+
+	switch cb.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if cb.trials >= cb.halfOpenRequests {
+			return false
+		}
+		cb.trials += 1
+	}
+	return true
+}
+
+// Gives back the trial slot of a request that was let through but whose
+// outcome won't be recorded - otherwise a half-open breaker runs out of them
+func (cb *circuitBreaker) release(now time.Time) {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	cb.refresh(now)
+
+	if cb.state == breakerHalfOpen && cb.trials > cb.successes {
+		cb.trials -= 1
+	}
+}
+
+// Records the outcome of a request
+func (cb *circuitBreaker) record(now time.Time, success bool) {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	cb.refresh(now)
+
+	switch cb.state {
+	case breakerOpen:
+		// Responses to requests sent before the breaker opened
+		return
+	case breakerHalfOpen:
+		if !success {
+			cb.setState(breakerOpen, now)
+			return
+		}
+		cb.successes += 1
+		if cb.successes >= cb.halfOpenRequests {
+			cb.setState(breakerClosed, now)
+		}
+		return
+	}
+
+	bucketSize := cb.window / BREAKER_BUCKETS
+	bucket := &cb.buckets[(now.UnixNano()/int64(max(bucketSize, 1)))%BREAKER_BUCKETS]
+	if now.Sub(bucket.start) >= bucketSize {
+		*bucket = breakerBucket{start: now.Truncate(max(bucketSize, 1))}
+	}
+	bucket.requests += 1
+	if success {
+		cb.failures = 0
+		return
+	}
+	bucket.failures += 1
+	cb.failures += 1
+
+	requests, failures := 0, 0
+	for _, b := range cb.buckets {
+		if now.Sub(b.start) < cb.window {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	if cb.failures >= cb.consecutiveFailures ||
+		(requests >= cb.minRequests && float64(failures) >= cb.errorRate*float64(requests)) {
+		cb.setState(breakerOpen, now)
+	}
+}
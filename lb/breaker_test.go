@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(transitions *[]breakerState) *circuitBreaker {
+	cfg := Config{
+		BreakerConsecutiveFailures: 3,
+		BreakerErrorRate:           0.5,
+		BreakerMinRequests:         10,
+		BreakerWindow:              time.Second * 10,
+		BreakerOpenDuration:        time.Second * 5,
+		BreakerHalfOpenRequests:    2,
+	}
+	return newCircuitBreaker(cfg, func(state breakerState) {
+		*transitions = append(*transitions, state)
+	})
+}
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	transitions := []breakerState{}
+	cb := newTestBreaker(&transitions)
+	now := time.Unix(1000, 0)
+
+	cb.record(now, false)
+	cb.record(now, false)
+	cb.record(now, true) // Success resets the count
+	cb.record(now, false)
+	cb.record(now, false)
+	if cb.State(now) != breakerClosed {
+		t.Fatal("breaker should still be closed")
+	}
+	cb.record(now, false)
+	if cb.State(now) != breakerOpen {
+		t.Fatal("3 failures in a row should open the breaker")
+	}
+	if cb.ready(now) || cb.allow(now) {
+		t.Error("open breaker should not let requests through")
+	}
+
+	// Half-open after the open duration with a limited number of trials
+	now = now.Add(time.Second * 5)
+	if !cb.ready(now) || cb.State(now) != breakerHalfOpen {
+		t.Fatal("breaker should be half-open after the open duration")
+	}
+	if !cb.allow(now) || !cb.allow(now) {
+		t.Fatal("half-open breaker should let 2 trial requests through")
+	}
+	if cb.ready(now) || cb.allow(now) {
+		t.Error("half-open breaker should not let more than 2 trial requests through")
+	}
+	cb.record(now, true)
+	if cb.State(now) != breakerHalfOpen {
+		t.Error("breaker should stay half-open until every trial succeeded")
+	}
+	cb.record(now, true)
+	if cb.State(now) != breakerClosed {
+		t.Error("breaker should close once every trial succeeded")
+	}
+
+	expected := []breakerState{breakerOpen, breakerHalfOpen, breakerClosed}
+	if len(transitions) != len(expected) {
+		t.Fatalf("Expected transitions: %v, Actual: %v\n", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Errorf("Expected transitions: %v, Actual: %v\n", expected, transitions)
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpenFailure(t *testing.T) {
+	transitions := []breakerState{}
+	cb := newTestBreaker(&transitions)
+	now := time.Unix(1000, 0)
+
+	for range 3 {
+		cb.record(now, false)
+	}
+	now = now.Add(time.Second * 5)
+	cb.allow(now)
+	cb.record(now, false)
+	if cb.State(now) != breakerOpen {
+		t.Fatal("a failed trial should open the breaker again")
+	}
+	if cb.State(now.Add(time.Second*4)) != breakerOpen {
+		t.Error("breaker should stay open for the whole open duration again")
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	transitions := []breakerState{}
+	cb := newTestBreaker(&transitions)
+	now := time.Unix(1000, 0)
+
+	// Alternating failures never reach 3 in a row but make up half the requests
+	for i := range 9 {
+		cb.record(now, i%2 == 1)
+	}
+	if cb.State(now) != breakerClosed {
+		t.Fatal("error rate should not be considered below the minimum requests")
+	}
+	cb.record(now, false)
+	if cb.State(now) != breakerOpen {
+		t.Fatal("50% failures over 10 requests should open the breaker")
+	}
+
+	// Failures older than the window are forgotten
+	cb = newTestBreaker(&transitions)
+	for i := range 9 {
+		cb.record(now, i%2 == 1)
+	}
+	later := now.Add(time.Second * 11)
+	cb.record(later, false)
+	if cb.State(later) != breakerClosed {
+		t.Error("requests outside of the window should not count towards the error rate")
+	}
+}
+
+func TestLBSkipsOpenBreakers(t *testing.T) {
+	lb, err := NewLB(t.Context(), "")
+	if err != nil {
+		t.Fatal("NewLB should not error here: ", err)
+	}
+	if err := lb.AddInstance("http://localhost:20000"); err != nil {
+		t.Fatal("AddInstance should not error here: ", err)
+	}
+	if err := lb.AddInstance("http://localhost:20001"); err != nil {
+		t.Fatal("AddInstance should not error here: ", err)
+	}
+	a, b := lb.instances[0], lb.instances[1]
+	a.healthy = true
+	b.healthy = true
+
+	for range DEFAULT_BREAKER_CONSECUTIVE_FAILURES {
+		lb.Observe(a, http.StatusBadGateway, time.Millisecond, nil)
+	}
+	if a.breaker.State(time.Now()) != breakerOpen {
+		t.Fatal("5xx responses should open the breaker")
+	}
+	for range 4 {
+		if ins := lb.GetInstance(); ins != b {
+			t.Fatal("instance with an open breaker should not be picked")
+		}
+	}
+
+	// Cancelled requests and errors don't count the same
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	for range DEFAULT_BREAKER_CONSECUTIVE_FAILURES {
+		_, err := b.roundTrip(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("error of a cancelled request should say so. Actual: ", err)
+		}
+		lb.Observe(b, 0, time.Millisecond, err)
+	}
+	if b.breaker.State(time.Now()) != breakerClosed {
+		t.Error("requests cancelled by the client should not open the breaker")
+	}
+	for range DEFAULT_BREAKER_CONSECUTIVE_FAILURES {
+		lb.Observe(b, 0, time.Millisecond, errors.New("connection refused"))
+	}
+	if b.breaker.State(time.Now()) != breakerOpen {
+		t.Error("errors reaching the instance should open the breaker")
+	}
+	if lb.GetInstance() != nil {
+		t.Error("no instance should be returned when every breaker is open")
+	}
+}
+
+func TestLBReleasesAbandonedTrials(t *testing.T) {
+	lb, err := NewLBWithConfig(t.Context(), Config{
+		BreakerOpenDuration:     time.Millisecond * 10,
+		BreakerHalfOpenRequests: 1,
+	})
+	if err != nil {
+		t.Fatal("NewLB should not error here: ", err)
+	}
+	if err := lb.AddInstance("http://localhost:20000"); err != nil {
+		t.Fatal("AddInstance should not error here: ", err)
+	}
+	a := lb.instances[0]
+	a.healthy = true
+
+	for range DEFAULT_BREAKER_CONSECUTIVE_FAILURES {
+		lb.Observe(a, http.StatusBadGateway, time.Millisecond, nil)
+	}
+	time.Sleep(time.Millisecond * 20)
+	for _, abandon := range []func(){
+		func() { lb.Observe(a, 0, time.Millisecond, context.Canceled) },
+		func() { lb.Observe(a, 0, time.Millisecond, context.DeadlineExceeded) },
+		func() { lb.Abandon(a) },
+	} {
+		if lb.GetInstance() != a {
+			t.Fatal("half-open breaker should let a trial request through")
+		}
+		if lb.GetInstance() != nil {
+			t.Fatal("half-open breaker should not let more trial requests through")
+		}
+		abandon()
+		if a.breaker.State(time.Now()) != breakerHalfOpen {
+			t.Fatal("abandoned trial should leave the breaker half-open")
+		}
+	}
+
+	// A trial that completes still closes it
+	if lb.GetInstance() != a {
+		t.Fatal("abandoned trial should be given back")
+	}
+	lb.Observe(a, http.StatusOK, time.Millisecond, nil)
+	if a.breaker.State(time.Now()) != breakerClosed {
+		t.Error("successful trial should close the breaker")
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds everything that can be tuned on the LB
+type Config struct {
+	InstanceList    string // Comma separated list of instance urls
+	Balancer        string // Name of the balancing strategy. See NewBalancer
+	HashKey         string // Request attribute the `hash` balancer routes on. See parseHashKey
+	BodyMemoryLimit int64  // Request bodies up to this many bytes are buffered in memory
+	BodyMaxSize     int64  // Request bodies declared larger than this are rejected, longer streams aren't recorded. Anything between the two is spilled to disk
+	BodyTempDir     string // Directory spilled request bodies are written to
+
+	RetryMaxAttempts        int           // Attempts per request, including the first one
+	RetryOn                 string        // What is retried. See newRetryPolicy
+	RetryBackoffBase        time.Duration // Backoff before the first retry. Doubles with every retry
+	RetryBackoffMax         time.Duration // Upper bound of the backoff
+	RetryBudgetRatio        float64       // Retries allowed as a fraction of requests
+	RetryBudgetMinPerSecond float64       // Retries allowed per second regardless of the ratio
+
+	BreakerConsecutiveFailures int           // Failures in a row that trip an instance's circuit breaker
+	BreakerErrorRate           float64       // Fraction of failed requests within the window that trips the breaker
+	BreakerMinRequests         int           // Requests needed within the window before the error rate is considered
+	BreakerWindow              time.Duration // Window the error rate is computed over
+	BreakerOpenDuration        time.Duration // How long a tripped breaker stays open before letting trial requests through
+	BreakerHalfOpenRequests    int           // Trial requests that have to succeed to close the breaker again
+
+	OutlierConsecutive5xx           int           // Failures in a row that eject an instance
+	OutlierInterval                 time.Duration // How often success rates are analysed
+	OutlierBaseEjection             time.Duration // Ejection duration. Multiplied by the number of times an instance has been ejected
+	OutlierMaxEjectionPercent       int           // Share of the pool that can be ejected at the same time
+	OutlierSuccessRateMinHosts      int           // Instances with enough traffic needed for the success rate analysis
+	OutlierSuccessRateRequestVolume int           // Requests within an interval an instance needs to be part of the success rate analysis
+	OutlierSuccessRateStdevFactor   float64       // Standard deviations below the mean success rate that eject an instance
+
+	HealthCheckPath           string        // Path health checks are sent to
+	HealthCheckMethod         string        // HTTP method of health checks
+	HealthCheckExpectedStatus string        // Status code, or inclusive range of codes, a passing check responds with. Eg: `200-299`
+	HealthCheckExpectedBody   string        // Substring the body of a passing check contains
+	HealthCheckExpectedJSON   string        // JSON field a passing check responds with. Eg: `status=ok`
+	HealthCheckInterval       time.Duration // Time between checks
+	HealthCheckTimeout        time.Duration // Time after which a check fails
+	HealthCheckJitter         time.Duration // Random extra delay added to every interval
+	HealthCheckRise           int           // Passing checks in a row that mark an unhealthy instance healthy
+	HealthCheckFall           int           // Failing checks in a row that mark a healthy instance unhealthy
+	HealthCheckGRPCService    string        // Service asked about by gRPC health checks
+
+	SlowStartWindow           time.Duration // Time over which an instance's share of traffic ramps up after it turns healthy. 0 disables slow start
+	SlowStartMinWeightPercent int           // Share of its weight an instance starts out with
+	SlowStartAggression       float64       // Shape of the ramp. 1 is linear
+
+	UpstreamMaxIdleConns          int           // Idle connections kept open across all instances
+	UpstreamMaxIdleConnsPerHost   int           // Idle connections kept open per instance
+	UpstreamIdleConnTimeout       time.Duration // Time after which an idle connection is closed
+	UpstreamDialTimeout           time.Duration // Time after which connecting to an instance fails
+	UpstreamKeepAlive             time.Duration // Interval of TCP keep-alive probes
+	UpstreamTLSHandshakeTimeout   time.Duration // Time after which a TLS handshake with an instance fails
+	UpstreamResponseHeaderTimeout time.Duration // Time after which an instance that hasn't sent response headers fails. 0 disables it
+	UpstreamCAFile                string        // PEM file of the CAs certificates of `https` instances are verified against. System CAs if empty
+	UpstreamServerName            string        // Server name expected of `https` instances. Their host if empty
+	UpstreamInsecureSkipVerify    bool          // Accept any certificate from `https` instances
+	UpstreamClientCertFile        string        // PEM certificate the LB authenticates itself to `https` instances with
+	UpstreamClientKeyFile         string        // PEM key of the client certificate
+
+	HeaderRules         string        // Headers passed on per route. See newHeaderPolicy
+	TrustedProxies      string        // Comma separated CIDRs of proxies whose forwarding headers are appended to rather than replaced
+	RequestIDHeader     string        // Header request IDs are read from, forwarded in and echoed in
+	RequestIDFormat     string        // Format of generated request IDs. `uuidv7` or `uuidv4`
+	UpgradeDrainTimeout time.Duration // Time upgraded connections - WebSockets and the like - get to finish once their instance is removed
+	FlushInterval       time.Duration // How often responses are flushed to the client while being copied. 0 leaves it to the server, negative flushes after every write
+
+	ListenAddr        string        // Address the LB listens on
+	H2C               bool          // Accept HTTP/2 without TLS on a plain listener
+	TLSCerts          string        // Comma separated `cert:key` PEM file pairs the listener terminates TLS with. Plain HTTP if empty
+	TLSMinVersion     string        // Lowest TLS version accepted by the listener. `1.0` to `1.3`
+	TLSCipherSuites   string        // Comma separated cipher suites accepted by the listener for TLS 1.2 and below. Go's defaults if empty
+	TLSReloadInterval time.Duration // How often certificate files are checked for changes
+
+	TLSClientCAFile      string // PEM file of the CAs client certificates are verified against. Clients aren't asked for one if empty
+	TLSClientAuth        string // `require` rejects clients without a valid certificate, `optional` only those with an invalid one
+	TLSClientIdentity    string // Part of the client certificate its identity is taken from. See newClientIdentities
+	TLSClientIdentityMap string // Comma separated `value=identity` pairs renaming identities
+	ClientIdentityHeader string // Header the client identity is forwarded to instances in
+
+	LatencyPercentile float64       // Latency percentile, 0-100, that decides whether an instance is too slow to be available
+	LatencyThreshold  time.Duration // Instances whose latency percentile is above this are unavailable
+	LatencyHalfLife   time.Duration // Time after which a latency sample counts for half as much
+	LatencyIdleReset  time.Duration // Latency samples are forgotten when an instance hasn't served a request for this long
+}
+
+const DEFAULT_BODY_MEMORY_LIMIT = 1 << 20
+const DEFAULT_BODY_MAX_SIZE = 64 << 20
+const DEFAULT_RETRY_MAX_ATTEMPTS = 2
+const DEFAULT_RETRY_ON = "error"
+const DEFAULT_RETRY_BACKOFF_BASE = time.Millisecond * 100
+const DEFAULT_RETRY_BACKOFF_MAX = time.Second * 2
+const DEFAULT_RETRY_BUDGET_RATIO = 0.2
+const DEFAULT_RETRY_BUDGET_MIN_PER_SECOND = 10
+const DEFAULT_BREAKER_CONSECUTIVE_FAILURES = 5
+const DEFAULT_BREAKER_ERROR_RATE = 0.5
+const DEFAULT_BREAKER_MIN_REQUESTS = 20
+const DEFAULT_BREAKER_WINDOW = time.Second * 10
+const DEFAULT_BREAKER_OPEN_DURATION = time.Second * 10
+const DEFAULT_BREAKER_HALF_OPEN_REQUESTS = 3
+const DEFAULT_OUTLIER_CONSECUTIVE_5XX = 5
+const DEFAULT_OUTLIER_INTERVAL = time.Second * 10
+const DEFAULT_OUTLIER_BASE_EJECTION = time.Second * 30
+const DEFAULT_OUTLIER_MAX_EJECTION_PERCENT = 50
+const DEFAULT_OUTLIER_SUCCESS_RATE_MIN_HOSTS = 3
+const DEFAULT_OUTLIER_SUCCESS_RATE_REQUEST_VOLUME = 20
+const DEFAULT_OUTLIER_SUCCESS_RATE_STDEV_FACTOR = 1.9
+const DEFAULT_SLOW_START_MIN_WEIGHT_PERCENT = 10
+const DEFAULT_SLOW_START_AGGRESSION = 1.0
+
+// Reads the LB configuration from environment variables. Unset variables are
+// left empty and fall back to their defaults
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		InstanceList: os.Getenv("LB_INSTANCELIST"),
+		Balancer:     os.Getenv("LB_BALANCER"),
+		HashKey:      os.Getenv("LB_HASH_KEY"),
+		BodyTempDir:  os.Getenv("LB_BODY_TEMP_DIR"),
+		RetryOn:      os.Getenv("LB_RETRY_ON"),
+
+		ListenAddr:      os.Getenv("LB_LISTEN_ADDR"),
+		TLSCerts:        os.Getenv("LB_TLS_CERTS"),
+		TLSMinVersion:   os.Getenv("LB_TLS_MIN_VERSION"),
+		TLSCipherSuites: os.Getenv("LB_TLS_CIPHER_SUITES"),
+
+		TLSClientCAFile:      os.Getenv("LB_TLS_CLIENT_CA_FILE"),
+		TLSClientAuth:        os.Getenv("LB_TLS_CLIENT_AUTH"),
+		TLSClientIdentity:    os.Getenv("LB_TLS_CLIENT_IDENTITY"),
+		TLSClientIdentityMap: os.Getenv("LB_TLS_CLIENT_IDENTITY_MAP"),
+		ClientIdentityHeader: os.Getenv("LB_CLIENT_IDENTITY_HEADER"),
+
+		HeaderRules:    os.Getenv("LB_HEADER_RULES"),
+		TrustedProxies: os.Getenv("LB_TRUSTED_PROXIES"),
+
+		RequestIDHeader: os.Getenv("LB_REQUEST_ID_HEADER"),
+		RequestIDFormat: os.Getenv("LB_REQUEST_ID_FORMAT"),
+
+		UpstreamCAFile:         os.Getenv("LB_UPSTREAM_CA_FILE"),
+		UpstreamServerName:     os.Getenv("LB_UPSTREAM_SERVER_NAME"),
+		UpstreamClientCertFile: os.Getenv("LB_UPSTREAM_CLIENT_CERT_FILE"),
+		UpstreamClientKeyFile:  os.Getenv("LB_UPSTREAM_CLIENT_KEY_FILE"),
+
+		HealthCheckPath:           os.Getenv("LB_HEALTH_CHECK_PATH"),
+		HealthCheckMethod:         os.Getenv("LB_HEALTH_CHECK_METHOD"),
+		HealthCheckExpectedStatus: os.Getenv("LB_HEALTH_CHECK_EXPECTED_STATUS"),
+		HealthCheckExpectedBody:   os.Getenv("LB_HEALTH_CHECK_EXPECTED_BODY"),
+		HealthCheckExpectedJSON:   os.Getenv("LB_HEALTH_CHECK_EXPECTED_JSON"),
+		HealthCheckGRPCService:    os.Getenv("LB_HEALTH_CHECK_GRPC_SERVICE"),
+	}
+
+	if err := envInt64("LB_BODY_MEMORY_LIMIT", &cfg.BodyMemoryLimit); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt64("LB_BODY_MAX_SIZE", &cfg.BodyMaxSize); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_RETRY_MAX_ATTEMPTS", &cfg.RetryMaxAttempts); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_RETRY_BACKOFF_BASE", &cfg.RetryBackoffBase); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_RETRY_BACKOFF_MAX", &cfg.RetryBackoffMax); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envFloat64("LB_RETRY_BUDGET_RATIO", &cfg.RetryBudgetRatio); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envFloat64("LB_RETRY_BUDGET_MIN_PER_SECOND", &cfg.RetryBudgetMinPerSecond); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_BREAKER_CONSECUTIVE_FAILURES", &cfg.BreakerConsecutiveFailures); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envFloat64("LB_BREAKER_ERROR_RATE", &cfg.BreakerErrorRate); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_BREAKER_MIN_REQUESTS", &cfg.BreakerMinRequests); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_BREAKER_WINDOW", &cfg.BreakerWindow); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_BREAKER_OPEN_DURATION", &cfg.BreakerOpenDuration); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_BREAKER_HALF_OPEN_REQUESTS", &cfg.BreakerHalfOpenRequests); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_OUTLIER_CONSECUTIVE_5XX", &cfg.OutlierConsecutive5xx); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_OUTLIER_INTERVAL", &cfg.OutlierInterval); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_OUTLIER_BASE_EJECTION", &cfg.OutlierBaseEjection); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_OUTLIER_MAX_EJECTION_PERCENT", &cfg.OutlierMaxEjectionPercent); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_OUTLIER_SUCCESS_RATE_MIN_HOSTS", &cfg.OutlierSuccessRateMinHosts); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_OUTLIER_SUCCESS_RATE_REQUEST_VOLUME", &cfg.OutlierSuccessRateRequestVolume); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envFloat64("LB_OUTLIER_SUCCESS_RATE_STDEV_FACTOR", &cfg.OutlierSuccessRateStdevFactor); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_HEALTH_CHECK_INTERVAL", &cfg.HealthCheckInterval); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_HEALTH_CHECK_TIMEOUT", &cfg.HealthCheckTimeout); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_HEALTH_CHECK_JITTER", &cfg.HealthCheckJitter); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_HEALTH_CHECK_RISE", &cfg.HealthCheckRise); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_HEALTH_CHECK_FALL", &cfg.HealthCheckFall); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_UPSTREAM_MAX_IDLE_CONNS", &cfg.UpstreamMaxIdleConns); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_UPSTREAM_MAX_IDLE_CONNS_PER_HOST", &cfg.UpstreamMaxIdleConnsPerHost); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_UPSTREAM_IDLE_CONN_TIMEOUT", &cfg.UpstreamIdleConnTimeout); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_UPSTREAM_DIAL_TIMEOUT", &cfg.UpstreamDialTimeout); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_UPSTREAM_KEEP_ALIVE", &cfg.UpstreamKeepAlive); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_UPSTREAM_TLS_HANDSHAKE_TIMEOUT", &cfg.UpstreamTLSHandshakeTimeout); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_UPSTREAM_RESPONSE_HEADER_TIMEOUT", &cfg.UpstreamResponseHeaderTimeout); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envBool("LB_UPSTREAM_INSECURE_SKIP_VERIFY", &cfg.UpstreamInsecureSkipVerify); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_UPGRADE_DRAIN_TIMEOUT", &cfg.UpgradeDrainTimeout); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_FLUSH_INTERVAL", &cfg.FlushInterval); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envBool("LB_H2C", &cfg.H2C); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_TLS_RELOAD_INTERVAL", &cfg.TLSReloadInterval); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envFloat64("LB_LATENCY_PERCENTILE", &cfg.LatencyPercentile); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_LATENCY_THRESHOLD", &cfg.LatencyThreshold); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_LATENCY_HALF_LIFE", &cfg.LatencyHalfLife); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_LATENCY_IDLE_RESET", &cfg.LatencyIdleReset); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envDuration("LB_SLOW_START_WINDOW", &cfg.SlowStartWindow); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envInt("LB_SLOW_START_MIN_WEIGHT_PERCENT", &cfg.SlowStartMinWeightPercent); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	if err := envFloat64("LB_SLOW_START_AGGRESSION", &cfg.SlowStartAggression); err != nil {
+		return cfg, fmt.Errorf("[ConfigFromEnv] -> %s", err.Error())
+	}
+	return cfg, nil
+}
+
+// Fills in defaults for everything left unset
+func (cfg Config) withDefaults() Config {
+	if cfg.BodyMemoryLimit <= 0 {
+		cfg.BodyMemoryLimit = DEFAULT_BODY_MEMORY_LIMIT
+	}
+	if cfg.BodyMaxSize <= 0 {
+		cfg.BodyMaxSize = DEFAULT_BODY_MAX_SIZE
+	}
+	if cfg.BodyTempDir == "" {
+		cfg.BodyTempDir = os.TempDir()
+	}
+	if cfg.RetryMaxAttempts <= 0 {
+		cfg.RetryMaxAttempts = DEFAULT_RETRY_MAX_ATTEMPTS
+	}
+	if cfg.RetryOn == "" {
+		cfg.RetryOn = DEFAULT_RETRY_ON
+	}
+	if cfg.RetryBackoffBase <= 0 {
+		cfg.RetryBackoffBase = DEFAULT_RETRY_BACKOFF_BASE
+	}
+	if cfg.RetryBackoffMax <= 0 {
+		cfg.RetryBackoffMax = DEFAULT_RETRY_BACKOFF_MAX
+	}
+	if cfg.RetryBudgetRatio <= 0 {
+		cfg.RetryBudgetRatio = DEFAULT_RETRY_BUDGET_RATIO
+	}
+	if cfg.RetryBudgetMinPerSecond <= 0 {
+		cfg.RetryBudgetMinPerSecond = DEFAULT_RETRY_BUDGET_MIN_PER_SECOND
+	}
+	if cfg.BreakerConsecutiveFailures <= 0 {
+		cfg.BreakerConsecutiveFailures = DEFAULT_BREAKER_CONSECUTIVE_FAILURES
+	}
+	if cfg.BreakerErrorRate <= 0 {
+		cfg.BreakerErrorRate = DEFAULT_BREAKER_ERROR_RATE
+	}
+	if cfg.BreakerMinRequests <= 0 {
+		cfg.BreakerMinRequests = DEFAULT_BREAKER_MIN_REQUESTS
+	}
+	if cfg.BreakerWindow <= 0 {
+		cfg.BreakerWindow = DEFAULT_BREAKER_WINDOW
+	}
+	if cfg.BreakerOpenDuration <= 0 {
+		cfg.BreakerOpenDuration = DEFAULT_BREAKER_OPEN_DURATION
+	}
+	if cfg.BreakerHalfOpenRequests <= 0 {
+		cfg.BreakerHalfOpenRequests = DEFAULT_BREAKER_HALF_OPEN_REQUESTS
+	}
+	if cfg.OutlierConsecutive5xx <= 0 {
+		cfg.OutlierConsecutive5xx = DEFAULT_OUTLIER_CONSECUTIVE_5XX
+	}
+	if cfg.OutlierInterval <= 0 {
+		cfg.OutlierInterval = DEFAULT_OUTLIER_INTERVAL
+	}
+	if cfg.OutlierBaseEjection <= 0 {
+		cfg.OutlierBaseEjection = DEFAULT_OUTLIER_BASE_EJECTION
+	}
+	if cfg.OutlierMaxEjectionPercent <= 0 {
+		cfg.OutlierMaxEjectionPercent = DEFAULT_OUTLIER_MAX_EJECTION_PERCENT
+	}
+	if cfg.OutlierSuccessRateMinHosts <= 0 {
+		cfg.OutlierSuccessRateMinHosts = DEFAULT_OUTLIER_SUCCESS_RATE_MIN_HOSTS
+	}
+	if cfg.OutlierSuccessRateRequestVolume <= 0 {
+		cfg.OutlierSuccessRateRequestVolume = DEFAULT_OUTLIER_SUCCESS_RATE_REQUEST_VOLUME
+	}
+	if cfg.OutlierSuccessRateStdevFactor <= 0 {
+		cfg.OutlierSuccessRateStdevFactor = DEFAULT_OUTLIER_SUCCESS_RATE_STDEV_FACTOR
+	}
+	if cfg.SlowStartMinWeightPercent <= 0 || cfg.SlowStartMinWeightPercent > 100 {
+		cfg.SlowStartMinWeightPercent = DEFAULT_SLOW_START_MIN_WEIGHT_PERCENT
+	}
+	if cfg.SlowStartAggression <= 0 {
+		cfg.SlowStartAggression = DEFAULT_SLOW_START_AGGRESSION
+	}
+	if cfg.UpstreamMaxIdleConns <= 0 {
+		cfg.UpstreamMaxIdleConns = DEFAULT_UPSTREAM_MAX_IDLE_CONNS
+	}
+	if cfg.UpstreamMaxIdleConnsPerHost <= 0 {
+		cfg.UpstreamMaxIdleConnsPerHost = DEFAULT_UPSTREAM_MAX_IDLE_CONNS_PER_HOST
+	}
+	if cfg.UpstreamIdleConnTimeout <= 0 {
+		cfg.UpstreamIdleConnTimeout = DEFAULT_UPSTREAM_IDLE_CONN_TIMEOUT
+	}
+	if cfg.UpstreamDialTimeout <= 0 {
+		cfg.UpstreamDialTimeout = DEFAULT_UPSTREAM_DIAL_TIMEOUT
+	}
+	if cfg.UpstreamKeepAlive <= 0 {
+		cfg.UpstreamKeepAlive = DEFAULT_UPSTREAM_KEEP_ALIVE
+	}
+	if cfg.UpstreamTLSHandshakeTimeout <= 0 {
+		cfg.UpstreamTLSHandshakeTimeout = DEFAULT_UPSTREAM_TLS_HANDSHAKE_TIMEOUT
+	}
+	if cfg.UpgradeDrainTimeout <= 0 {
+		cfg.UpgradeDrainTimeout = DEFAULT_UPGRADE_DRAIN_TIMEOUT
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = DEFAULT_LISTEN_ADDR
+	}
+	if cfg.TLSMinVersion == "" {
+		cfg.TLSMinVersion = DEFAULT_TLS_MIN_VERSION
+	}
+	if cfg.TLSClientAuth == "" {
+		cfg.TLSClientAuth = REQUIRE_CLIENT_AUTH
+	}
+	if cfg.TLSReloadInterval <= 0 {
+		cfg.TLSReloadInterval = DEFAULT_TLS_RELOAD_INTERVAL
+	}
+	if cfg.LatencyPercentile <= 0 {
+		cfg.LatencyPercentile = DEFAULT_LATENCY_PERCENTILE
+	}
+	if cfg.LatencyThreshold <= 0 {
+		cfg.LatencyThreshold = DEFAULT_LATENCY_THRESHOLD
+	}
+	if cfg.LatencyHalfLife <= 0 {
+		cfg.LatencyHalfLife = DEFAULT_LATENCY_HALF_LIFE
+	}
+	if cfg.LatencyIdleReset <= 0 {
+		cfg.LatencyIdleReset = DEFAULT_LATENCY_IDLE_RESET
+	}
+	return cfg
+}
+
+// Parses the environment variable `name` into `dst` if it is set
+func envInt64(name string, dst *int64) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid `%s`. Expected an integer. Actual: `%s`", name, value)
+	}
+	*dst = v
+	return nil
+}
+
+func envInt(name string, dst *int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid `%s`. Expected an integer. Actual: `%s`", name, value)
+	}
+	*dst = v
+	return nil
+}
+
+func envFloat64(name string, dst *float64) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid `%s`. Expected a number. Actual: `%s`", name, value)
+	}
+	*dst = v
+	return nil
+}
+
+func envBool(name string, dst *bool) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid `%s`. Expected `true` or `false`. Actual: `%s`", name, value)
+	}
+	*dst = v
+	return nil
+}
+
+// Durations are written the way time.ParseDuration expects them. Eg: `1.5s`
+func envDuration(name string, dst *time.Duration) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid `%s`. Expected a duration. Actual: `%s`", name, value)
+	}
+	*dst = v
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Name the LB goes by in Via headers
+const VIA_PSEUDONYM = "lb"
+
+// Adds the headers that tell instances who the request came from and how it
+// reached the LB - X-Forwarded-For/Proto/Host, RFC 7239 Forwarded and Via.
+// Forwarding headers of requests from trusted proxies are appended to, those
+// of anyone else are replaced since they can't be relied on
+type forwarding struct {
+	trusted []netip.Prefix
+}
+
+// Parses a comma separated list of trusted proxies - CIDRs or single IPs
+func newForwarding(trustedProxies string) (*forwarding, error) {
+	f := &forwarding{}
+	for _, proxy := range strings.Split(trustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("[newForwarding] -> invalid trusted proxy: `%s`. Expected a CIDR or an IP", proxy)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		f.trusted = append(f.trusted, prefix.Masked())
+	}
+	return f, nil
+}
+
+func (f *forwarding) isTrusted(addr netip.Addr) bool {
+	if f == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range f.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the forwarding headers of `out`, the request to the instance, from
+// `req`, the request the LB received
+func (f *forwarding) apply(out http.Header, req *http.Request) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	client, _ := netip.ParseAddr(host)
+	if !f.isTrusted(client) {
+		out.Del("X-Forwarded-For")
+		out.Del("X-Forwarded-Proto")
+		out.Del("X-Forwarded-Host")
+		out.Del("Forwarded")
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if prior := strings.Join(out.Values("X-Forwarded-For"), ", "); prior != "" {
+		out.Set("X-Forwarded-For", prior+", "+host)
+	} else {
+		out.Set("X-Forwarded-For", host)
+	}
+	// Kept as they are when set by a trusted proxy closer to the client
+	if out.Get("X-Forwarded-Proto") == "" {
+		out.Set("X-Forwarded-Proto", proto)
+	}
+	if out.Get("X-Forwarded-Host") == "" && req.Host != "" {
+		out.Set("X-Forwarded-Host", req.Host)
+	}
+
+	element := "for=" + forwardedNode(client, host)
+	if req.Host != "" {
+		element += ";host=" + forwardedValue(req.Host)
+	}
+	element += ";proto=" + proto
+	if prior := strings.Join(out.Values("Forwarded"), ", "); prior != "" {
+		out.Set("Forwarded", prior+", "+element)
+	} else {
+		out.Set("Forwarded", element)
+	}
+
+	// Via lists every intermediary regardless of trust
+	via := fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, VIA_PSEUDONYM)
+	if req.ProtoMajor >= 2 {
+		via = fmt.Sprintf("%d %s", req.ProtoMajor, VIA_PSEUDONYM)
+	}
+	if prior := strings.Join(out.Values("Via"), ", "); prior != "" {
+		out.Set("Via", prior+", "+via)
+	} else {
+		out.Set("Via", via)
+	}
+}
+
+// Node of a Forwarded `for` parameter per RFC 7239 section 6. IPv6 addresses
+// are bracketed and quoted, anything that isn't an IP is obfuscated
+func forwardedNode(addr netip.Addr, raw string) string {
+	switch {
+	case addr.Is4() || addr.Is4In6():
+		return addr.Unmap().String()
+	case addr.Is6():
+		return `"[` + addr.String() + `]"`
+	case raw == "":
+		return "unknown"
+	}
+	return forwardedValue("_" + raw)
+}
+
+// Quotes a Forwarded parameter value unless it is a plain token
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) && !('0' <= c && c <= '9') && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewForwarding(t *testing.T) {
+	f, err := newForwarding("10.0.0.0/8, 192.168.1.1 ,::1")
+	if err != nil {
+		t.Fatal("newForwarding should not error here: ", err)
+	}
+	if len(f.trusted) != 3 {
+		t.Errorf("Expected 3 trusted proxies. Actual: %d", len(f.trusted))
+	}
+	if _, err := newForwarding("10.0.0.0/33"); err == nil {
+		t.Error("invalid CIDR should be rejected")
+	}
+	if _, err := newForwarding("proxy.local"); err == nil {
+		t.Error("host name should be rejected")
+	}
+}
+
+func TestForwardingUntrustedReplaces(t *testing.T) {
+	f, _ := newForwarding("10.0.0.0/8")
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	out := http.Header{}
+	out.Set("X-Forwarded-For", "1.2.3.4")
+	out.Set("X-Forwarded-Proto", "https")
+	out.Set("X-Forwarded-Host", "spoofed.com")
+	out.Set("Forwarded", "for=1.2.3.4")
+	out.Set("Via", "1.1 edge")
+	f.apply(out, req)
+
+	expected := map[string]string{
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "example.com",
+		"Forwarded":         "for=203.0.113.7;host=example.com;proto=http",
+		"Via":               "1.1 edge, 1.1 lb",
+	}
+	for k, v := range expected {
+		if out.Get(k) != v {
+			t.Errorf("%s: Expected: `%s`. Actual: `%s`", k, v, out.Get(k))
+		}
+	}
+}
+
+func TestForwardingTrustedAppends(t *testing.T) {
+	f, _ := newForwarding("10.0.0.0/8")
+	req := httptest.NewRequest(http.MethodGet, "https://internal:8443/path", nil)
+	req.RemoteAddr = "10.1.2.3:4000"
+	req.TLS = &tls.ConnectionState{}
+	out := http.Header{}
+	out.Add("X-Forwarded-For", "198.51.100.1")
+	out.Add("X-Forwarded-For", "10.9.9.9")
+	out.Set("X-Forwarded-Proto", "https")
+	out.Set("X-Forwarded-Host", "example.com")
+	out.Set("Forwarded", `for="[2001:db8::1]";proto=https`)
+	f.apply(out, req)
+
+	expected := map[string]string{
+		"X-Forwarded-For":   "198.51.100.1, 10.9.9.9, 10.1.2.3",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "example.com",
+		"Forwarded":         `for="[2001:db8::1]";proto=https, for=10.1.2.3;host="internal:8443";proto=https`,
+	}
+	for k, v := range expected {
+		if out.Get(k) != v {
+			t.Errorf("%s: Expected: `%s`. Actual: `%s`", k, v, out.Get(k))
+		}
+	}
+}
+
+func TestForwardedNode(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "[2001:db8::2]:4000"
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	out := http.Header{}
+	(*forwarding)(nil).apply(out, req)
+
+	if out.Get("Forwarded") != `for="[2001:db8::2]";host=example.com;proto=http` {
+		t.Error("IPv6 node should be bracketed and quoted. Actual: ", out.Get("Forwarded"))
+	}
+	if out.Get("Via") != "2 lb" {
+		t.Error("Via should carry the protocol version. Actual: ", out.Get("Via"))
+	}
+}
+
+func TestProxyAddsForwardingHeaders(t *testing.T) {
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, req.Header.Get("X-Forwarded-For")+"|"+req.Header.Get("Via"))
+	}))
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4") // Not from a trusted proxy
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "127.0.0.1|1.1 lb" {
+		t.Errorf("instance should see the client's address. Actual: `%s`", body)
+	}
+}
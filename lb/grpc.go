@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Names of gRPC status codes as they are used in `LB_RETRY_ON`, prefixed
+// with `grpc-`. Eg: `grpc-unavailable`
+var GRPC_STATUS_NAMES = map[codes.Code]string{
+	codes.Canceled:           "cancelled",
+	codes.Unknown:            "unknown",
+	codes.InvalidArgument:    "invalid-argument",
+	codes.DeadlineExceeded:   "deadline-exceeded",
+	codes.NotFound:           "not-found",
+	codes.AlreadyExists:      "already-exists",
+	codes.PermissionDenied:   "permission-denied",
+	codes.ResourceExhausted:  "resource-exhausted",
+	codes.FailedPrecondition: "failed-precondition",
+	codes.Aborted:            "aborted",
+	codes.OutOfRange:         "out-of-range",
+	codes.Unimplemented:      "unimplemented",
+	codes.Internal:           "internal",
+	codes.Unavailable:        "unavailable",
+	codes.DataLoss:           "data-loss",
+	codes.Unauthenticated:    "unauthenticated",
+}
+
+// Units of the grpc-timeout header, largest first
+var GRPC_TIMEOUT_UNITS = []struct {
+	unit     byte
+	duration time.Duration
+}{
+	{'H', time.Hour},
+	{'M', time.Minute},
+	{'S', time.Second},
+	{'m', time.Millisecond},
+	{'u', time.Microsecond},
+	{'n', time.Nanosecond},
+}
+
+// Whether `h` belongs to a gRPC request or response
+func isGRPC(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "application/grpc")
+}
+
+// Looks up a gRPC status code by its name in `LB_RETRY_ON`
+func parseGRPCStatus(name string) (codes.Code, bool) {
+	for code, n := range GRPC_STATUS_NAMES {
+		if n == name {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// The gRPC status of `resp`. Responses without messages carry it in their
+// headers (trailers-only), all others in their trailers - which are only
+// there once the body has been read
+func grpcStatus(resp *http.Response) (codes.Code, bool) {
+	value := resp.Header.Get("Grpc-Status")
+	if value == "" && resp.Trailer != nil {
+		value = resp.Trailer.Get("Grpc-Status")
+	}
+	code, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return codes.Code(code), true
+}
+
+// HTTP status equivalent to a gRPC status, so that gRPC calls are judged by
+// the circuit breakers and outlier detection the way other requests are
+func grpcHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client closed request
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// Status of `resp` as far as the instance's health is concerned. For gRPC
+// responses that's the gRPC status. A gRPC response that was read to the end
+// without one was cut off
+func responseStatus(resp *http.Response, bodyRead bool) int {
+	if !isGRPC(resp.Header) {
+		return resp.StatusCode
+	}
+	if code, ok := grpcStatus(resp); ok {
+		return grpcHTTPStatus(code)
+	}
+	if bodyRead && resp.StatusCode == http.StatusOK {
+		return http.StatusBadGateway
+	}
+	return resp.StatusCode
+}
+
+// Parses a grpc-timeout header - at most 8 digits followed by a unit. Eg: `100m`
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+	for _, u := range GRPC_TIMEOUT_UNITS {
+		if u.unit == value[len(value)-1] {
+			if amount > math.MaxInt64/int64(u.duration) {
+				return math.MaxInt64, true
+			}
+			return time.Duration(amount) * u.duration, true
+		}
+	}
+	return 0, false
+}
+
+// Formats `d` as a grpc-timeout header in the finest unit that fits 8
+// digits, rounding up so that the instance never gets less time than is left
+func formatGRPCTimeout(d time.Duration) string {
+	d = max(d, time.Nanosecond)
+	for i := len(GRPC_TIMEOUT_UNITS) - 1; i >= 0; i-- {
+		u := GRPC_TIMEOUT_UNITS[i]
+		amount := (d + u.duration - 1) / u.duration
+		if amount < 100_000_000 {
+			return fmt.Sprintf("%d%c", amount, u.unit)
+		}
+	}
+	return "99999999H"
+}
+
+// Tells the instance how much of the client's deadline is left for the call
+func propagateGRPCDeadline(out http.Header, req *http.Request) {
+	if !isGRPC(req.Header) {
+		return
+	}
+	if deadline, ok := req.Context().Deadline(); ok {
+		out.Set("Grpc-Timeout", formatGRPCTimeout(time.Until(deadline)))
+	}
+}
+
+// Responds to a gRPC client with an error of its own kind - a trailers-only
+// response - since gRPC clients don't look at HTTP statuses or bodies
+func writeGRPCError(res http.ResponseWriter, req *http.Request, status int, message string) {
+	code := codes.Unknown
+	switch status {
+	case http.StatusBadRequest:
+		code = codes.Internal
+	case http.StatusRequestEntityTooLarge:
+		code = codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+	if id := requestID(req); id != "" {
+		message += " (request id: " + id + ")"
+	}
+	res.Header().Set("Content-Type", "application/grpc")
+	res.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	res.Header().Set("Grpc-Message", url.PathEscape(message))
+	res.WriteHeader(http.StatusOK)
+	GRPC_STATUS_METRIC.WithLabelValues(code.String()).Inc()
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// In-process gRPC server serving the standard health service. `intercept`
+// stands in for the health service when set. Returns the instance spec and
+// the number of calls it got
+func newGRPCInstance(t *testing.T, intercept grpc.UnaryServerInterceptor) (string, *atomic.Int64) {
+	t.Helper()
+	calls := &atomic.Int64{}
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		calls.Add(1)
+		if intercept != nil {
+			return intercept(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+	return "http://" + ln.Addr().String() + ";proto=h2c;check=tcp", calls
+}
+
+// Runs an h2c LB configured with `cfg` in front of `instances` and returns a
+// health client connected to it
+func newGRPCProxy(t *testing.T, cfg Config, instances ...string) healthpb.HealthClient {
+	t.Helper()
+	cfg.H2C = true
+	cfg = cfg.withDefaults()
+	var err error
+	G_LB, err = NewLBWithConfig(t.Context(), cfg)
+	if err != nil {
+		t.Fatal("NewLB should not error here: ", err)
+	}
+	for _, spec := range instances {
+		if err := G_LB.AddInstance(spec); err != nil {
+			t.Fatal("AddInstance should not error here: ", err)
+		}
+	}
+	for _, ins := range G_LB.instances {
+		ins.healthy = true
+	}
+
+	mux := http.NewServeMux()
+	router(mux)
+	server, err := newServer(t.Context(), cfg, G_LB.requestIDs.handler(mux))
+	if err != nil {
+		t.Fatal("newServer should not error here: ", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+// Fails after the response headers went out, so the status ends up in the trailers
+func failAfterHeaders(code codes.Code) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, _ any, _ *grpc.UnaryServerInfo, _ grpc.UnaryHandler) (any, error) {
+		grpc.SendHeader(ctx, metadata.Pairs("x-sent", "headers"))
+		return nil, status.Error(code, "failed after headers")
+	}
+}
+
+func TestGRPCPerCallBalancing(t *testing.T) {
+	tagged := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			grpc.SetTrailer(ctx, metadata.Pairs("x-instance", name))
+			return handler(ctx, req)
+		}
+	}
+	a, aCalls := newGRPCInstance(t, tagged("a"))
+	b, bCalls := newGRPCInstance(t, tagged("b"))
+	client := newGRPCProxy(t, Config{}, a, b)
+
+	// All calls go over the one client connection and still spread out
+	seen := map[string]int{}
+	for range 10 {
+		var trailer metadata.MD
+		resp, err := client.Check(t.Context(), &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer))
+		if err != nil {
+			t.Fatal("call should succeed: ", err)
+		}
+		if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Expected: `SERVING`. Actual: `%s`\n", resp.GetStatus())
+		}
+		if values := trailer.Get("x-instance"); len(values) == 1 {
+			seen[values[0]] += 1
+		}
+	}
+	if aCalls.Load() != 5 || bCalls.Load() != 5 {
+		t.Errorf("calls should be balanced round robin. Actual: a=%d b=%d\n", aCalls.Load(), bCalls.Load())
+	}
+	if seen["a"] != 5 || seen["b"] != 5 {
+		t.Error("trailers of the instances should be relayed. Actual: ", seen)
+	}
+	if n := testutil.ToFloat64(UPSTREAM_PROTOCOL_METRIC.WithLabelValues(G_LB.instances[0].url, "HTTP/2.0")); n < 5 {
+		t.Errorf("calls should reach instances over HTTP/2. Actual: %v\n", n)
+	}
+}
+
+func TestGRPCStatuses(t *testing.T) {
+	a, _ := newGRPCInstance(t, nil)
+	client := newGRPCProxy(t, Config{}, a)
+
+	// Trailers-only response
+	_, err := client.Check(t.Context(), &healthpb.HealthCheckRequest{Service: "unknown.Service"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected: `NotFound`. Actual: %v\n", err)
+	}
+
+	// Status in the trailers
+	b, _ := newGRPCInstance(t, failAfterHeaders(codes.PermissionDenied))
+	client = newGRPCProxy(t, Config{}, b)
+	var header metadata.MD
+	_, err = client.Check(t.Context(), &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	if status.Code(err) != codes.PermissionDenied || status.Convert(err).Message() != "failed after headers" {
+		t.Errorf("Expected: `PermissionDenied`. Actual: %v\n", err)
+	}
+	if values := header.Get("x-sent"); len(values) != 1 {
+		t.Error("headers of the instance should be relayed")
+	}
+
+	// Errors of the LB itself are gRPC errors too
+	client = newGRPCProxy(t, Config{})
+	_, err = client.Check(t.Context(), &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unavailable || !strings.Contains(status.Convert(err).Message(), "no available instance") {
+		t.Errorf("Expected: `Unavailable`. Actual: %v\n", err)
+	}
+}
+
+func TestGRPCRetry(t *testing.T) {
+	unavailable := func(context.Context, any, *grpc.UnaryServerInfo, grpc.UnaryHandler) (any, error) {
+		return nil, status.Error(codes.Unavailable, "going away")
+	}
+	a, aCalls := newGRPCInstance(t, unavailable)
+	b, bCalls := newGRPCInstance(t, nil)
+	client := newGRPCProxy(t, Config{RetryOn: "grpc-unavailable", RetryBackoffBase: time.Millisecond}, a, b)
+
+	for range 6 {
+		if _, err := client.Check(t.Context(), &healthpb.HealthCheckRequest{}); err != nil {
+			t.Fatal("unavailable instance should be retried: ", err)
+		}
+	}
+	if aCalls.Load() == 0 || bCalls.Load() != 6 {
+		t.Errorf("every call should end up at `b`. Actual: a=%d b=%d\n", aCalls.Load(), bCalls.Load())
+	}
+
+	// Once a message may have gone out the call can't be retried
+	a, _ = newGRPCInstance(t, failAfterHeaders(codes.Unavailable))
+	client = newGRPCProxy(t, Config{RetryOn: "grpc-unavailable"}, a, b)
+	failed := 0
+	for range 2 {
+		if _, err := client.Check(t.Context(), &healthpb.HealthCheckRequest{}); status.Code(err) == codes.Unavailable {
+			failed += 1
+		}
+	}
+	if failed != 1 {
+		t.Errorf("the call to `a` should fail without a retry. Failed: %d of 2\n", failed)
+	}
+}
+
+func TestGRPCOutlierDetection(t *testing.T) {
+	a, _ := newGRPCInstance(t, failAfterHeaders(codes.Internal))
+	b, _ := newGRPCInstance(t, nil)
+	client := newGRPCProxy(t, Config{OutlierConsecutive5xx: 3}, a, b)
+
+	for range 6 {
+		client.Check(t.Context(), &healthpb.HealthCheckRequest{})
+	}
+	if !G_LB.instances[0].isEjected(time.Now()) {
+		t.Error("instance failing calls should be ejected")
+	}
+	if G_LB.instances[1].isEjected(time.Now()) {
+		t.Error("instance serving calls should not be ejected")
+	}
+
+	// A failure on the client's side is not the instance's
+	c, _ := newGRPCInstance(t, func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return nil, status.Error(codes.InvalidArgument, "bad request")
+	})
+	client = newGRPCProxy(t, Config{OutlierConsecutive5xx: 3}, c, b)
+	for range 6 {
+		client.Check(t.Context(), &healthpb.HealthCheckRequest{})
+	}
+	if G_LB.instances[0].isEjected(time.Now()) {
+		t.Error("instance rejecting invalid calls should not be ejected")
+	}
+}
+
+func TestGRPCDeadlinePropagation(t *testing.T) {
+	var remaining atomic.Int64
+	a, _ := newGRPCInstance(t, func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if deadline, ok := ctx.Deadline(); ok {
+			remaining.Store(int64(time.Until(deadline)))
+		}
+		return handler(ctx, req)
+	})
+	client := newGRPCProxy(t, Config{}, a)
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*2)
+	defer cancel()
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal("call should succeed: ", err)
+	}
+	if d := time.Duration(remaining.Load()); d <= time.Second || d > time.Second*2 {
+		t.Errorf("instance should get what's left of the deadline. Actual: %s\n", d)
+	}
+
+	// The LB gives up on an instance that takes too long itself
+	timeouts := make(chan string, 1)
+	slow := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		timeouts <- req.Header.Get("Grpc-Timeout")
+		<-req.Context().Done()
+	}))
+	slow.Config.Protocols = &http.Protocols{}
+	slow.Config.Protocols.SetUnencryptedHTTP2(true)
+	slow.Start()
+	defer slow.Close()
+	newGRPCProxy(t, Config{}, slow.URL+";proto=h2c")
+	proxy := httptest.NewServer(http.HandlerFunc(proxyHandler))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/grpc.health.v1.Health/Check", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "100m")
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if code := resp.Header.Get("Grpc-Status"); code != "4" {
+		t.Errorf("Expected grpc-status `4` (DeadlineExceeded). Actual: `%s`\n", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call should end at its deadline. Elapsed: %s\n", elapsed)
+	}
+	timeout, _ := parseGRPCTimeout(<-timeouts)
+	if timeout <= 0 || timeout > time.Millisecond*100 {
+		t.Errorf("instance should be told what's left of the deadline. Actual: %s\n", timeout)
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	valid := map[string]time.Duration{
+		"1H":        time.Hour,
+		"2M":        time.Minute * 2,
+		"3S":        time.Second * 3,
+		"100m":      time.Millisecond * 100,
+		"5u":        time.Microsecond * 5,
+		"99999999n": time.Nanosecond * 99999999,
+	}
+	for value, expected := range valid {
+		if actual, ok := parseGRPCTimeout(value); !ok || actual != expected {
+			t.Errorf("`%s` - Expected: %s. Actual: %s\n", value, expected, actual)
+		}
+		if formatted, _ := parseGRPCTimeout(formatGRPCTimeout(expected)); formatted != expected {
+			t.Errorf("%s should survive formatting. Actual: %s\n", expected, formatted)
+		}
+	}
+	for _, value := range []string{"", "1", "m", "-1S", "1s", "123456789S"} {
+		if _, ok := parseGRPCTimeout(value); ok {
+			t.Errorf("`%s` should be rejected\n", value)
+		}
+	}
+	if actual := formatGRPCTimeout(time.Millisecond*1500 + 1); actual != "1500001u" {
+		t.Errorf("timeouts should be rounded up. Actual: `%s`\n", actual)
+	}
+}
+
+func TestGRPCRetryPolicy(t *testing.T) {
+	policy, err := newRetryPolicy(Config{RetryOn: "grpc-unavailable, grpc-resource-exhausted"})
+	if err != nil {
+		t.Fatal("newRetryPolicy should not error here: ", err)
+	}
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{
+		"Content-Type": {"application/grpc"},
+		"Grpc-Status":  {"14"},
+	}}
+	if reason := policy.retryReason(resp, nil); reason != "grpc-unavailable" {
+		t.Errorf("Expected: `grpc-unavailable`. Actual: `%s`\n", reason)
+	}
+	resp.Header.Set("Grpc-Status", "13")
+	if reason := policy.retryReason(resp, nil); reason != "" {
+		t.Errorf("internal should not be retried. Actual: `%s`\n", reason)
+	}
+	if _, err := newRetryPolicy(Config{RetryOn: "grpc-nope"}); err == nil {
+		t.Error("unknown gRPC status should be rejected")
+	}
+	if status := grpcHTTPStatus(codes.Unavailable); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected: `503`. Actual: `%d`\n", status)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request attribute a consistent hash is computed on
+type hashKey struct {
+	source string // One of `ip`, `identity`, `header`, `cookie` or `json`
+	name   string // Header name, cookie name or dot separated path to a JSON field
+}
+
+const DEFAULT_HASH_KEY = "ip"
+
+// Only this much of a request body is looked at to find a JSON hash key
+const HASH_KEY_MAX_BODY = 1 << 20
+
+// Parses a hash key of the form `ip`, `identity`, `header:<name>`,
+// `cookie:<name>` or `json:<path.to.field>`. `identity` is the identity of
+// the client's certificate. See clientIdentities
+func parseHashKey(key string) (hashKey, error) {
+	if key == "" {
+		key = DEFAULT_HASH_KEY
+	}
+	source, name, _ := strings.Cut(key, ":")
+	switch source {
+	case "ip", "identity":
+		if name != "" {
+			break
+		}
+		return hashKey{source: source}, nil
+	case "header", "cookie", "json":
+		if name == "" {
+			break
+		}
+		return hashKey{source: source, name: name}, nil
+	}
+	return hashKey{}, fmt.Errorf("[parseHashKey] -> invalid hash key: `%s`", key)
+}
+
+// Extracts the key's value from `req`. `ok` is false if `req` doesn't carry it
+func (k hashKey) value(req *http.Request) (value string, ok bool) {
+	if req == nil {
+		return "", false
+	}
+	switch k.source {
+	case "ip":
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		return host, host != ""
+	case "identity":
+		value = clientIdentity(req)
+		return value, value != ""
+	case "header":
+		value = req.Header.Get(k.name)
+		return value, value != ""
+	case "cookie":
+		cookie, err := req.Cookie(k.name)
+		if err != nil {
+			return "", false
+		}
+		return cookie.Value, cookie.Value != ""
+	case "json":
+		return jsonField(req, k.name)
+	}
+	return "", false
+}
+
+// Looks up a dot separated path in a JSON request body. The body is put back
+// on the request so it can still be proxied
+func jsonField(req *http.Request, path string) (string, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", false
+	}
+	bs, err := io.ReadAll(io.LimitReader(req.Body, HASH_KEY_MAX_BODY))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(bs), req.Body), req.Body}
+	if err != nil {
+		return "", false
+	}
+	return lookupJSONPath(bs, path)
+}
+
+// Looks up a dot separated path in a JSON document. Strings, numbers and
+// booleans are returned as they are written
+func lookupJSONPath(bs []byte, path string) (string, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "", false
+	}
+	for _, field := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		value, ok = object[field]
+		if !ok {
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case json.Number, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// Number of points every unit of weight puts on the ring. More points spread
+// keys more evenly
+const HASH_RING_POINTS = 160
+
+type ringPoint struct {
+	hash     uint64
+	instance *Instance
+}
+
+// Consistent hashing on a ring.
+// Every instance is placed at HASH_RING_POINTS x weight points of the ring and a
+// request goes to the owner of the first point at or after its key's hash.
+// Adding or removing an instance only moves the keys between it and its
+// neighbours. If the owner is unavailable the next instance along the ring is
+// used. Requests without a key are balanced round robin
+type consistentHash struct {
+	mx       sync.RWMutex
+	key      hashKey
+	ring     []ringPoint
+	fallback roundRobin
+}
+
+// 64 bit FNV-1a followed by a finalizer so that similar inputs spread evenly
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (ch *consistentHash) Pick(instances []*Instance, req *http.Request) *Instance {
+	value, ok := ch.key.value(req)
+	if !ok {
+		return ch.fallback.Pick(instances, req)
+	}
+
+	candidates := make(map[*Instance]bool, len(instances))
+	for _, ins := range instances {
+		candidates[ins] = true
+	}
+
+	ch.mx.RLock()
+	defer ch.mx.RUnlock()
+
+	n := len(ch.ring)
+	if n == 0 {
+		return nil
+	}
+	h := hash64(value)
+	start, _ := slices.BinarySearchFunc(ch.ring, h, func(p ringPoint, h uint64) int {
+		if p.hash < h {
+			return -1
+		} else if p.hash > h {
+			return 1
+		}
+		return 0
+	})
+
+	// Walk the ring until an available instance turns up, skipping instances
+	// that have already been looked at
+	seen := map[*Instance]bool{}
+	for i := range n {
+		ins := ch.ring[(start+i)%n].instance
+		if seen[ins] {
+			continue
+		}
+		seen[ins] = true
+		if candidates[ins] && ins.isAvailable() {
+			return ins
+		}
+	}
+	return nil
+}
+
+// Keys stay on their owner even while it is in slow start
+func (ch *consistentHash) handlesSlowStart() {}
+
+func (ch *consistentHash) Observe(*Instance, time.Duration, error) {}
+
+func (ch *consistentHash) Add(ins *Instance) {
+	ch.mx.Lock()
+	defer ch.mx.Unlock()
+
+	for i := range HASH_RING_POINTS * ins.weight {
+		ch.ring = append(ch.ring, ringPoint{
+			hash:     hash64(fmt.Sprintf("%s-%d", ins.url, i)),
+			instance: ins,
+		})
+	}
+	slices.SortFunc(ch.ring, func(a, b ringPoint) int {
+		if a.hash < b.hash {
+			return -1
+		} else if a.hash > b.hash {
+			return 1
+		}
+		return strings.Compare(a.instance.url, b.instance.url)
+	})
+}
+
+func (ch *consistentHash) Remove(ins *Instance) {
+	ch.mx.Lock()
+	defer ch.mx.Unlock()
+
+	ch.ring = slices.DeleteFunc(ch.ring, func(p ringPoint) bool {
+		return p.instance == ins
+	})
+}
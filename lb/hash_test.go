@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newHashBalancer(t *testing.T, key string, instances ...*Instance) Balancer {
+	balancer, err := NewBalancer(Config{Balancer: "hash", HashKey: key})
+	if err != nil {
+		t.Fatal("NewBalancer should not error here: ", err)
+	}
+	for _, ins := range instances {
+		balancer.Add(ins)
+	}
+	return balancer
+}
+
+func headerRequest(value string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User", value)
+	return req
+}
+
+func TestParseHashKey(t *testing.T) {
+	valid := map[string]hashKey{
+		"":               {source: "ip"},
+		"ip":             {source: "ip"},
+		"identity":       {source: "identity"},
+		"header:X-User":  {source: "header", name: "X-User"},
+		"cookie:session": {source: "cookie", name: "session"},
+		"json:user.id":   {source: "json", name: "user.id"},
+	}
+	for key, expected := range valid {
+		actual, err := parseHashKey(key)
+		if err != nil || actual != expected {
+			t.Errorf("`%s`: Expected: %v, Actual: %v (err: %v)\n", key, expected, actual, err)
+		}
+	}
+
+	for _, key := range []string{"header", "cookie:", "ip:x", "identity:x", "query:id"} {
+		if _, err := parseHashKey(key); err == nil || !strings.HasPrefix(err.Error(), "[parseHashKey] -> invalid hash key: ") {
+			t.Errorf("`%s` should be rejected. Actual: %v\n", key, err)
+		}
+	}
+
+	if _, err := NewBalancer(Config{Balancer: "hash", HashKey: "query:id"}); err == nil {
+		t.Error("NewBalancer should error for an invalid hash key")
+	}
+}
+
+func TestHashKeyValue(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"user":{"id":42,"name":"a"}}`))
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("X-User", "alice")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	req = req.WithContext(context.WithValue(req.Context(), clientIdentityKey{}, "billing"))
+
+	cases := map[string]string{
+		"ip":             "10.0.0.1",
+		"identity":       "billing",
+		"header:X-User":  "alice",
+		"cookie:session": "s1",
+		"json:user.id":   "42",
+	}
+	for key, expected := range cases {
+		k, _ := parseHashKey(key)
+		actual, ok := k.value(req)
+		if !ok || actual != expected {
+			t.Errorf("`%s`: Expected: `%s`, Actual: `%s`\n", key, expected, actual)
+		}
+	}
+
+	// Body must still be intact for proxying after a JSON key lookup
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != `{"user":{"id":42,"name":"a"}}` {
+		t.Error("request body was not restored. Actual: ", string(body))
+	}
+
+	k, _ := parseHashKey("json:user.missing")
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"user":{"id":42}}`))
+	if _, ok := k.value(req); ok {
+		t.Error("missing JSON field should not produce a key")
+	}
+}
+
+func TestConsistentHashAffinity(t *testing.T) {
+	a := &Instance{url: "http://a", weight: 1, healthy: true}
+	b := &Instance{url: "http://b", weight: 1, healthy: true}
+	c := &Instance{url: "http://c", weight: 1, healthy: true}
+	instances := []*Instance{a, b, c}
+	balancer := newHashBalancer(t, "header:X-User", instances...)
+
+	owners := map[string]*Instance{}
+	counts := map[*Instance]int{}
+	for i := range 300 {
+		key := fmt.Sprintf("user-%d", i)
+		owners[key] = balancer.Pick(instances, headerRequest(key))
+		counts[owners[key]] += 1
+	}
+	for _, ins := range instances {
+		if counts[ins] < 50 {
+			t.Errorf("keys are not spread evenly across instances: %s got %d of 300\n", ins.url, counts[ins])
+		}
+	}
+
+	// Same key - same instance
+	for key, owner := range owners {
+		if ins := balancer.Pick(instances, headerRequest(key)); ins != owner {
+			t.Fatalf("`%s` moved from `%s` to `%s`\n", key, owner.url, ins.url)
+		}
+	}
+
+	// Unavailable owner falls back to another node and comes back afterwards
+	var key string
+	for k, owner := range owners {
+		if owner == a {
+			key = k
+			break
+		}
+	}
+	a.healthy = false
+	if ins := balancer.Pick(instances, headerRequest(key)); ins == nil || ins == a {
+		t.Error("request should have fallen back to the next available instance")
+	}
+	a.healthy = true
+	if ins := balancer.Pick(instances, headerRequest(key)); ins != a {
+		t.Error("request should be back on its owner once it is available")
+	}
+
+	// Requests without the key are still served
+	if balancer.Pick(instances, httptest.NewRequest(http.MethodGet, "/", nil)) == nil {
+		t.Error("requests without a key should be balanced round robin")
+	}
+}
+
+func TestConsistentHashMinimalRemapping(t *testing.T) {
+	a := &Instance{url: "http://a", weight: 1, healthy: true}
+	b := &Instance{url: "http://b", weight: 1, healthy: true}
+	c := &Instance{url: "http://c", weight: 1, healthy: true}
+	d := &Instance{url: "http://d", weight: 1, healthy: true}
+	balancer := newHashBalancer(t, "header:X-User", a, b, c)
+
+	before := map[string]*Instance{}
+	for i := range 1000 {
+		key := fmt.Sprintf("user-%d", i)
+		before[key] = balancer.Pick([]*Instance{a, b, c}, headerRequest(key))
+	}
+
+	balancer.Add(d)
+	moved := 0
+	for key, owner := range before {
+		ins := balancer.Pick([]*Instance{a, b, c, d}, headerRequest(key))
+		if ins != owner {
+			moved += 1
+			if ins != d {
+				t.Fatalf("`%s` moved between existing instances `%s` -> `%s`\n", key, owner.url, ins.url)
+			}
+		}
+	}
+	// Roughly a quarter of the keys should move to the new instance
+	if moved < 150 || moved > 350 {
+		t.Errorf("Expected about 250 of 1000 keys to move. Actual: %d\n", moved)
+	}
+
+	balancer.Remove(d)
+	for key, owner := range before {
+		if ins := balancer.Pick([]*Instance{a, b, c}, headerRequest(key)); ins != owner {
+			t.Fatalf("`%s` should be back on `%s` after removal. Actual: `%s`\n", key, owner.url, ins.url)
+		}
+	}
+}
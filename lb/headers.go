@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Hop-by-hop headers. These only make sense for a single transport-level
+// connection and are removed before forwarding to the instance and before
+// relaying the response back to the client.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Removes hop-by-hop headers - the ones above and, per RFC 9110 section
+// 7.6.1, any the sender listed in its Connection header
+func removeHopHeaders(h http.Header) {
+	for _, token := range headerTokens(h.Values("Connection")) {
+		h.Del(token)
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// Headers passed on for requests whose path starts with `prefix`. An allow
+// list keeps only the headers on it, a deny list removes the headers on it
+type headerRule struct {
+	prefix        string
+	requestAllow  map[string]bool
+	requestDeny   map[string]bool
+	responseAllow map[string]bool
+	responseDeny  map[string]bool
+}
+
+// Header rules per route. The rule with the longest matching prefix applies
+type headerPolicy struct {
+	rules []*headerRule
+}
+
+// Parses header rules of the form
+// `<path prefix> <directive>=<header>,<header>... [<directive>=...]` separated
+// by `;`. Directives are `request-allow`, `request-deny`, `response-allow` and
+// `response-deny`. Eg: `/api request-deny=Cookie response-deny=Server;/ response-deny=X-Powered-By`
+func newHeaderPolicy(spec string) (*headerPolicy, error) {
+	hp := &headerPolicy{}
+	for _, ruleSpec := range strings.Split(spec, ";") {
+		fields := strings.Fields(ruleSpec)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(fields[0], "/") || len(fields) == 1 {
+			return nil, fmt.Errorf("[newHeaderPolicy] -> invalid header rule: `%s`. Expected: `<path prefix> <directive>=<headers>`", strings.TrimSpace(ruleSpec))
+		}
+		rule := &headerRule{prefix: fields[0]}
+		for _, directive := range fields[1:] {
+			name, list, _ := strings.Cut(directive, "=")
+			headers := map[string]bool{}
+			for _, h := range strings.Split(list, ",") {
+				if h = strings.TrimSpace(h); h != "" {
+					headers[http.CanonicalHeaderKey(h)] = true
+				}
+			}
+			switch name {
+			case "request-allow":
+				rule.requestAllow = headers
+			case "request-deny":
+				rule.requestDeny = headers
+			case "response-allow":
+				rule.responseAllow = headers
+			case "response-deny":
+				rule.responseDeny = headers
+			default:
+				return nil, fmt.Errorf("[newHeaderPolicy] -> invalid header rule directive: `%s`. Expected one of `request-allow`, `request-deny`, `response-allow` or `response-deny`", name)
+			}
+		}
+		hp.rules = append(hp.rules, rule)
+	}
+	sort.SliceStable(hp.rules, func(i, j int) bool {
+		return len(hp.rules[i].prefix) > len(hp.rules[j].prefix)
+	})
+	return hp, nil
+}
+
+// Rule for requests to `path`. Nil if no rule applies
+func (hp *headerPolicy) ruleFor(path string) *headerRule {
+	if hp == nil {
+		return nil
+	}
+	for _, rule := range hp.rules {
+		if strings.HasPrefix(path, rule.prefix) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func filterHeader(h http.Header, allow, deny map[string]bool) {
+	for k := range h {
+		if (allow != nil && !allow[k]) || deny[k] {
+			delete(h, k)
+		}
+	}
+}
+
+// Removes the request headers the rule doesn't let through to the instance
+func (r *headerRule) filterRequest(h http.Header) {
+	if r != nil {
+		filterHeader(h, r.requestAllow, r.requestDeny)
+	}
+}
+
+// Removes the response headers and trailers the rule doesn't let through to
+// the client
+func (r *headerRule) filterResponse(h http.Header) {
+	if r != nil {
+		filterHeader(h, r.responseAllow, r.responseDeny)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "close, X-Hop")
+	h.Add("Connection", "keep-alive")
+	h.Set("X-Hop", "1")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Upgrade", "websocket")
+	h.Set("X-End-To-End", "1")
+	removeHopHeaders(h)
+
+	if len(h) != 1 || h.Get("X-End-To-End") != "1" {
+		t.Error("only end-to-end headers should be left. Actual: ", h)
+	}
+}
+
+func TestNewHeaderPolicy(t *testing.T) {
+	hp, err := newHeaderPolicy("/ response-deny=server ; /api request-deny=Cookie,x-debug response-allow=Content-Type")
+	if err != nil {
+		t.Fatal("newHeaderPolicy should not error here: ", err)
+	}
+	if rule := hp.ruleFor("/api/items"); rule == nil || rule.prefix != "/api" || !rule.requestDeny["X-Debug"] || !rule.responseAllow["Content-Type"] {
+		t.Error("longest matching prefix should apply. Actual: ", rule)
+	}
+	if rule := hp.ruleFor("/other"); rule == nil || rule.prefix != "/" || !rule.responseDeny["Server"] {
+		t.Error("root rule should apply to every other path. Actual: ", rule)
+	}
+
+	empty, err := newHeaderPolicy("")
+	if err != nil || empty.ruleFor("/") != nil {
+		t.Error("empty spec should have no rules")
+	}
+
+	for _, spec := range []string{"api request-deny=Cookie", "/api", "/api request-block=Cookie"} {
+		if _, err := newHeaderPolicy(spec); err == nil {
+			t.Errorf("`%s` should be rejected", spec)
+		}
+	}
+}
+
+func TestHeaderRuleFilter(t *testing.T) {
+	hp, _ := newHeaderPolicy("/ request-allow=Accept,Authorization response-deny=Set-Cookie")
+	rule := hp.ruleFor("/")
+
+	req := http.Header{"Accept": {"*/*"}, "Authorization": {"token"}, "Cookie": {"a=b"}}
+	rule.filterRequest(req)
+	if !reflect.DeepEqual(req, http.Header{"Accept": {"*/*"}, "Authorization": {"token"}}) {
+		t.Error("only allowed request headers should be left. Actual: ", req)
+	}
+
+	resp := http.Header{"Content-Type": {"text/plain"}, "Set-Cookie": {"a=b"}}
+	rule.filterResponse(resp)
+	if !reflect.DeepEqual(resp, http.Header{"Content-Type": {"text/plain"}}) {
+		t.Error("denied response headers should be removed. Actual: ", resp)
+	}
+
+	var none *headerRule
+	none.filterRequest(req)
+	if len(req) != 2 {
+		t.Error("nil rule should leave headers as they are")
+	}
+}
+
+func TestProxyHeaderFidelity(t *testing.T) {
+	received := make(chan http.Header, 1)
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("Cache-Control", "no-store")
+		res.Header().Add("Set-Cookie", "a=1")
+		res.Header().Add("Set-Cookie", "b=2")
+		res.Header().Set("X-Custom", "custom")
+		res.Header().Set("Connection", "X-Internal")
+		res.Header().Set("X-Internal", "secret")
+		res.Header().Set("Trailer", "X-Checksum")
+		res.WriteHeader(http.StatusCreated)
+		io.WriteString(res, "{}")
+		res.Header().Set("X-Checksum", "abc")
+	}))
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/items", nil)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-Multi", "1")
+	req.Header.Add("X-Multi", "2")
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "hop")
+	req.Header.Set("Proxy-Authorization", "proxy-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	io.ReadAll(resp.Body)
+
+	upstream := <-received
+	if upstream.Get("Accept") != "application/json" || upstream.Get("Authorization") != "Bearer token" || !reflect.DeepEqual(upstream.Values("X-Multi"), []string{"1", "2"}) {
+		t.Error("end-to-end request headers should reach the instance unchanged. Actual: ", upstream)
+	}
+	if upstream.Get("X-Hop") != "" || upstream.Get("Proxy-Authorization") != "" {
+		t.Error("hop-by-hop request headers should not reach the instance. Actual: ", upstream)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Error("status should be relayed. Actual: ", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" || resp.Header.Get("Cache-Control") != "no-store" || resp.Header.Get("X-Custom") != "custom" {
+		t.Error("end-to-end response headers should reach the client unchanged. Actual: ", resp.Header)
+	}
+	if !reflect.DeepEqual(resp.Header.Values("Set-Cookie"), []string{"a=1", "b=2"}) {
+		t.Error("every Set-Cookie should be relayed. Actual: ", resp.Header.Values("Set-Cookie"))
+	}
+	if resp.Header.Get("X-Internal") != "" {
+		t.Error("headers listed in Connection should not reach the client")
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Error("trailers should be relayed. Actual: ", resp.Trailer)
+	}
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	received := make(chan http.Header, 1)
+	proxy := newStreamingProxy(t, Config{HeaderRules: "/private request-deny=Cookie response-deny=Server"}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+		res.Header().Set("Server", "instance")
+	}))
+
+	for path, filtered := range map[string]bool{"/private/data": true, "/public": false} {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+path, nil)
+		req.Header.Set("Cookie", "session=1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		upstream := <-received
+		if (upstream.Get("Cookie") == "") != filtered || (resp.Header.Get("Server") == "") != filtered {
+			t.Errorf("%s: headers should be filtered only on matching routes. Cookie: `%s`, Server: `%s`", path, upstream.Get("Cookie"), resp.Header.Get("Server"))
+		}
+	}
+}
+
+func TestProxyHeaderRulesKeepLBHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	proxy := newStreamingProxy(t, Config{HeaderRules: "/ request-allow=Content-Type"}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+	}))
+	proxy.Config.Handler = G_LB.requestIDs.handler(http.HandlerFunc(proxyHandler))
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "5S")
+	req.Header.Set("X-Custom", "custom")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Rules apply to what the client sent, not to what the LB adds
+	upstream := <-received
+	if upstream.Get("X-Custom") != "" || upstream.Get("Content-Type") != "application/grpc" {
+		t.Error("client headers should be filtered by the rule: ", upstream)
+	}
+	if upstream.Get("X-Forwarded-For") != "127.0.0.1" || upstream.Get("X-Forwarded-Proto") != "http" ||
+		upstream.Get("Forwarded") == "" || upstream.Get("Via") != "1.1 lb" {
+		t.Error("forwarding headers should be added after the rule: ", upstream)
+	}
+	if upstream.Get("X-Request-Id") == "" {
+		t.Error("request ID should be added after the rule")
+	}
+	if timeout, ok := parseGRPCTimeout(upstream.Get("Grpc-Timeout")); !ok || timeout > time.Second*5 {
+		t.Errorf("remaining deadline should be added after the rule. Actual: `%s`", upstream.Get("Grpc-Timeout"))
+	}
+}
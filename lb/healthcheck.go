@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Only this much of a health check response body is looked at
+const HEALTH_CHECK_MAX_BODY = 64 << 10
+
+// Active health check sent to every instance. How an instance is checked
+// depends on its check type, the timing is shared by all of them
+type healthCheck struct {
+	path         string
+	method       string
+	statusMin    int
+	statusMax    int
+	bodyContains string // Expected substring of the response body
+	jsonField    string // Dot separated path to a JSON field expected to equal jsonValue
+	jsonValue    string
+	interval     time.Duration
+	timeout      time.Duration
+	jitter       time.Duration // Random extra delay added to every interval
+	rise         int           // Passing checks in a row that mark an unhealthy instance healthy
+	fall         int           // Failing checks in a row that mark a healthy instance unhealthy
+	grpcService  string        // Service asked about by gRPC checks. Empty for the server as a whole
+	transport    http.RoundTripper
+}
+
+// Check types an instance can be health checked with
+const HTTP_HEALTH_CHECK = "http"
+const TCP_HEALTH_CHECK = "tcp"
+const GRPC_HEALTH_CHECK = "grpc"
+
+func validHealthCheckType(kind string) bool {
+	switch kind {
+	case HTTP_HEALTH_CHECK, TCP_HEALTH_CHECK, GRPC_HEALTH_CHECK:
+		return true
+	}
+	return false
+}
+
+// A healthChecker runs a single check against the instance at `url`. A nil
+// error means it passed
+type healthChecker interface {
+	check(ctx context.Context, url string) error
+}
+
+const DEFAULT_HEALTH_CHECK_PATH = "/health"
+const DEFAULT_HEALTH_CHECK_EXPECTED_STATUS = "200-399"
+const DEFAULT_HEALTH_CHECK_INTERVAL = time.Second
+const DEFAULT_HEALTH_CHECK_TIMEOUT = time.Millisecond * 10
+const DEFAULT_HEALTH_CHECK_RISE = 1
+const DEFAULT_HEALTH_CHECK_FALL = 2
+
+func defaultHealthCheck() *healthCheck {
+	hc, _ := newHealthCheck(Config{})
+	return hc
+}
+
+// Builds the health check from `cfg`. The expected status is either a single
+// code or an inclusive range like `200-299`. The expected JSON is written as
+// `path.to.field=value`
+func newHealthCheck(cfg Config) (*healthCheck, error) {
+	hc := &healthCheck{
+		path:         cfg.HealthCheckPath,
+		method:       cfg.HealthCheckMethod,
+		bodyContains: cfg.HealthCheckExpectedBody,
+		interval:     cfg.HealthCheckInterval,
+		timeout:      cfg.HealthCheckTimeout,
+		jitter:       cfg.HealthCheckJitter,
+		rise:         cfg.HealthCheckRise,
+		fall:         cfg.HealthCheckFall,
+		grpcService:  cfg.HealthCheckGRPCService,
+		transport:    defaultUpstreamTransport,
+	}
+	if hc.path == "" {
+		hc.path = DEFAULT_HEALTH_CHECK_PATH
+	}
+	if !strings.HasPrefix(hc.path, "/") {
+		hc.path = "/" + hc.path
+	}
+	if hc.method == "" {
+		hc.method = http.MethodGet
+	}
+	if hc.interval <= 0 {
+		hc.interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if hc.timeout <= 0 {
+		hc.timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	if hc.jitter < 0 {
+		hc.jitter = 0
+	}
+	if hc.rise <= 0 {
+		hc.rise = DEFAULT_HEALTH_CHECK_RISE
+	}
+	if hc.fall <= 0 {
+		hc.fall = DEFAULT_HEALTH_CHECK_FALL
+	}
+
+	status := cfg.HealthCheckExpectedStatus
+	if status == "" {
+		status = DEFAULT_HEALTH_CHECK_EXPECTED_STATUS
+	}
+	minStatus, maxStatus, isRange := strings.Cut(status, "-")
+	if !isRange {
+		maxStatus = minStatus
+	}
+	var err1, err2 error
+	hc.statusMin, err1 = strconv.Atoi(strings.TrimSpace(minStatus))
+	hc.statusMax, err2 = strconv.Atoi(strings.TrimSpace(maxStatus))
+	if err1 != nil || err2 != nil || hc.statusMin < 100 || hc.statusMax > 599 || hc.statusMin > hc.statusMax {
+		return nil, fmt.Errorf("[newHealthCheck] -> invalid expected status: `%s`", status)
+	}
+
+	if cfg.HealthCheckExpectedJSON != "" {
+		field, value, ok := strings.Cut(cfg.HealthCheckExpectedJSON, "=")
+		if !ok || field == "" {
+			return nil, fmt.Errorf("[newHealthCheck] -> invalid expected JSON: `%s`. Expected: `path.to.field=value`", cfg.HealthCheckExpectedJSON)
+		}
+		hc.jsonField = field
+		hc.jsonValue = value
+	}
+	return hc, nil
+}
+
+// Time to wait until the next check
+func (hc *healthCheck) next() time.Duration {
+	if hc.jitter <= 0 {
+		return hc.interval
+	}
+	return hc.interval + rand.N(hc.jitter)
+}
+
+// Runs a check of type `kind` once against the instance at `url`. A nil error
+// means it passed
+func (hc *healthCheck) check(ctx context.Context, kind string, url string) error {
+	return hc.checkWith(ctx, kind, url, hc.transport)
+}
+
+// Same as check, with requests going through `transport` - the one the
+// instance is proxied to through
+func (hc *healthCheck) checkWith(ctx context.Context, kind string, url string, transport http.RoundTripper) error {
+	return hc.checkOver(ctx, kind, url, transport, nil)
+}
+
+// Same as checkWith. gRPC checks go over `grpcConn` if it isn't nil
+func (hc *healthCheck) checkOver(ctx context.Context, kind string, url string, transport http.RoundTripper, grpcConn *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+
+	var checker healthChecker
+	switch kind {
+	case TCP_HEALTH_CHECK:
+		checker = tcpChecker{}
+	case GRPC_HEALTH_CHECK:
+		checker = grpcChecker{service: hc.grpcService, transport: transport, conn: grpcConn}
+	default:
+		checker = httpChecker{healthCheck: hc, transport: transport}
+	}
+	return checker.check(ctx, url)
+}
+
+// Sends an HTTP request and checks the response status and, optionally, body
+type httpChecker struct {
+	*healthCheck
+	transport http.RoundTripper
+}
+
+func (c httpChecker) check(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(withConnTrace(ctx, url), c.method, url+c.path, nil)
+	if err != nil {
+		return fmt.Errorf("[httpChecker.check] -> error creating request: %s", err)
+	}
+	client := http.Client{
+		Transport: c.transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("[httpChecker.check] -> %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < c.statusMin || resp.StatusCode > c.statusMax {
+		return fmt.Errorf("[httpChecker.check] -> unexpected status: %d", resp.StatusCode)
+	}
+	if c.bodyContains == "" && c.jsonField == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, HEALTH_CHECK_MAX_BODY))
+	if err != nil {
+		return fmt.Errorf("[httpChecker.check] -> error reading body: %s", err)
+	}
+	if c.bodyContains != "" && !strings.Contains(string(body), c.bodyContains) {
+		return fmt.Errorf("[httpChecker.check] -> body does not contain `%s`", c.bodyContains)
+	}
+	if c.jsonField != "" {
+		value, ok := lookupJSONPath(body, c.jsonField)
+		if !ok || value != c.jsonValue {
+			return fmt.Errorf("[httpChecker.check] -> JSON field `%s` is `%s`. Expected: `%s`", c.jsonField, value, c.jsonValue)
+		}
+	}
+	return nil
+}
+
+// Passes if a TCP connection can be established
+type tcpChecker struct{}
+
+func (c tcpChecker) check(ctx context.Context, instanceURL string) error {
+	u, err := url.Parse(instanceURL)
+	if err != nil {
+		return fmt.Errorf("[tcpChecker.check] -> %s", err)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return fmt.Errorf("[tcpChecker.check] -> %s", err)
+	}
+	return conn.Close()
+}
+
+// Uses the standard gRPC health checking protocol - grpc.health.v1.Health/Check.
+// Passes if the service is SERVING
+type grpcChecker struct {
+	service   string
+	transport http.RoundTripper // `https` instances are checked with its TLS configuration
+	conn      *grpc.ClientConn  // Connection to check over. One is dialed for the check if nil
+}
+
+// Opens a gRPC client connection to the instance at `instanceURL`. It is
+// only established with the first call and reconnects on its own from then on
+func dialGRPC(instanceURL string, transport http.RoundTripper) (*grpc.ClientConn, error) {
+	u, err := url.Parse(instanceURL)
+	if err != nil {
+		return nil, fmt.Errorf("[dialGRPC] -> %s", err)
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == "https" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if t, ok := transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+			tlsConfig = t.TLSClientConfig.Clone()
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("[dialGRPC] -> %s", err)
+	}
+	return conn, nil
+}
+
+func (c grpcChecker) check(ctx context.Context, instanceURL string) error {
+	conn := c.conn
+	if conn == nil {
+		var err error
+		conn, err = dialGRPC(instanceURL, c.transport)
+		if err != nil {
+			return fmt.Errorf("[grpcChecker.check] -> %s", err)
+		}
+		defer conn.Close()
+	}
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: c.service})
+	if err != nil {
+		return fmt.Errorf("[grpcChecker.check] -> %s", err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("[grpcChecker.check] -> service `%s` is %s", c.service, resp.GetStatus())
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestNewHealthCheck(t *testing.T) {
+	hc, err := newHealthCheck(Config{})
+	if err != nil {
+		t.Fatal("newHealthCheck should not error here: ", err)
+	}
+	if hc.path != "/health" || hc.method != http.MethodGet || hc.statusMin != 200 || hc.statusMax != 399 ||
+		hc.interval != time.Second || hc.rise != 1 || hc.fall != 2 {
+		t.Errorf("unexpected defaults: %+v\n", hc)
+	}
+
+	hc, err = newHealthCheck(Config{
+		HealthCheckPath:           "ready",
+		HealthCheckMethod:         http.MethodHead,
+		HealthCheckExpectedStatus: "204",
+		HealthCheckExpectedJSON:   "status.db=up",
+	})
+	if err != nil {
+		t.Fatal("newHealthCheck should not error here: ", err)
+	}
+	if hc.path != "/ready" || hc.method != http.MethodHead || hc.statusMin != 204 || hc.statusMax != 204 ||
+		hc.jsonField != "status.db" || hc.jsonValue != "up" {
+		t.Errorf("config was not applied: %+v\n", hc)
+	}
+
+	for _, status := range []string{"abc", "300-200", "200-700", "99"} {
+		_, err := newHealthCheck(Config{HealthCheckExpectedStatus: status})
+		if err == nil || !strings.HasPrefix(err.Error(), "[newHealthCheck] -> invalid expected status: ") {
+			t.Errorf("`%s` should be rejected. Actual: %v\n", status, err)
+		}
+	}
+	if _, err := newHealthCheck(Config{HealthCheckExpectedJSON: "status"}); err == nil {
+		t.Error("expected JSON without a value should be rejected")
+	}
+	if _, err := NewLBWithConfig(t.Context(), Config{HealthCheckExpectedStatus: "abc"}); err == nil {
+		t.Error("NewLBWithConfig should error for an invalid health check")
+	}
+}
+
+func TestHealthCheckCheck(t *testing.T) {
+	status := http.StatusOK
+	body := `{"status":{"db":"up"}}`
+	delay := time.Duration(0)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+		if req.URL.Path != "/ready" || req.Method != http.MethodPost {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		res.WriteHeader(status)
+		res.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	hc, err := newHealthCheck(Config{
+		HealthCheckPath:           "/ready",
+		HealthCheckMethod:         http.MethodPost,
+		HealthCheckExpectedStatus: "200-299",
+		HealthCheckExpectedBody:   "db",
+		HealthCheckExpectedJSON:   "status.db=up",
+		HealthCheckTimeout:        time.Millisecond * 200,
+	})
+	if err != nil {
+		t.Fatal("newHealthCheck should not error here: ", err)
+	}
+
+	if err := hc.check(t.Context(), HTTP_HEALTH_CHECK, server.URL); err != nil {
+		t.Error("check should pass: ", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := hc.check(t.Context(), HTTP_HEALTH_CHECK, server.URL); err == nil {
+		t.Error("check should fail on an unexpected status")
+	}
+
+	status = http.StatusOK
+	body = `{"status":{"db":"down"}}`
+	if err := hc.check(t.Context(), HTTP_HEALTH_CHECK, server.URL); err == nil {
+		t.Error("check should fail when the JSON field doesn't match")
+	}
+
+	body = `{"status":"ok"}`
+	if err := hc.check(t.Context(), HTTP_HEALTH_CHECK, server.URL); err == nil {
+		t.Error("check should fail when the body doesn't contain the expected substring")
+	}
+
+	body = `{"status":{"db":"up"}}`
+	delay = time.Millisecond * 300
+	if err := hc.check(t.Context(), HTTP_HEALTH_CHECK, server.URL); err == nil {
+		t.Error("check should fail when the instance takes longer than the timeout")
+	}
+}
+
+func TestInstanceRecordHealthCheck(t *testing.T) {
+	ins, err := NewInstance("http://localhost:20000")
+	if err != nil {
+		t.Fatal("NewInstance should not error here: ", err)
+	}
+	ins.healthCheck, _ = newHealthCheck(Config{HealthCheckRise: 3, HealthCheckFall: 2})
+	failed := errors.New("failed")
+
+	// First result is taken as is
+	ins.recordHealthCheck(nil)
+	if !ins.healthy {
+		t.Fatal("first passing check should mark the instance healthy")
+	}
+
+	ins.recordHealthCheck(failed)
+	if !ins.healthy {
+		t.Error("a single failing check should not mark the instance unhealthy")
+	}
+	ins.recordHealthCheck(nil)
+	ins.recordHealthCheck(failed)
+	if !ins.healthy {
+		t.Error("failures that aren't in a row should not mark the instance unhealthy")
+	}
+	ins.recordHealthCheck(failed)
+	if ins.healthy {
+		t.Fatal("2 failing checks in a row should mark the instance unhealthy")
+	}
+
+	ins.recordHealthCheck(nil)
+	ins.recordHealthCheck(nil)
+	if ins.healthy {
+		t.Error("flapping instance should not come back before 3 passing checks")
+	}
+	ins.recordHealthCheck(nil)
+	if !ins.healthy {
+		t.Error("3 passing checks in a row should mark the instance healthy")
+	}
+}
+
+func TestTCPHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	addr := listener.Addr().String()
+
+	hc, _ := newHealthCheck(Config{HealthCheckTimeout: time.Millisecond * 200})
+	if err := hc.check(t.Context(), TCP_HEALTH_CHECK, "http://"+addr); err != nil {
+		t.Error("check should pass while the port accepts connections: ", err)
+	}
+
+	listener.Close()
+	if err := hc.check(t.Context(), TCP_HEALTH_CHECK, "http://"+addr); err == nil {
+		t.Error("check should fail once the port is closed")
+	}
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	instanceURL := fmt.Sprintf("http://%s", listener.Addr())
+	hc, _ := newHealthCheck(Config{HealthCheckTimeout: time.Second, HealthCheckGRPCService: "echo.Echo"})
+
+	healthServer.SetServingStatus("echo.Echo", healthpb.HealthCheckResponse_SERVING)
+	if err := hc.check(t.Context(), GRPC_HEALTH_CHECK, instanceURL); err != nil {
+		t.Error("check should pass while the service is serving: ", err)
+	}
+
+	healthServer.SetServingStatus("echo.Echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	if err := hc.check(t.Context(), GRPC_HEALTH_CHECK, instanceURL); err == nil {
+		t.Error("check should fail while the service is not serving")
+	}
+
+	hc.grpcService = "unknown.Service"
+	if err := hc.check(t.Context(), GRPC_HEALTH_CHECK, instanceURL); err == nil {
+		t.Error("check should fail for a service the server doesn't know")
+	}
+
+	// The whole server - empty service name
+	hc.grpcService = ""
+	if err := hc.check(t.Context(), GRPC_HEALTH_CHECK, instanceURL); err != nil {
+		t.Error("check of the server as a whole should pass: ", err)
+	}
+
+	server.Stop()
+	if err := hc.check(t.Context(), GRPC_HEALTH_CHECK, instanceURL); err == nil {
+		t.Error("check should fail once the server is down")
+	}
+}
+
+// Counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestInstanceMonitorReusesGRPCConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	listener := &countingListener{Listener: ln}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	ins, err := NewInstance(fmt.Sprintf("http://%s;check=grpc", ln.Addr()))
+	if err != nil {
+		t.Fatal("NewInstance should not error here: ", err)
+	}
+	ins.healthCheck, _ = newHealthCheck(Config{HealthCheckInterval: time.Millisecond * 20, HealthCheckTimeout: time.Millisecond * 200})
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		ins.monitor(ctx)
+		close(stopped)
+	}()
+
+	time.Sleep(time.Millisecond * 200)
+	ins.mx.Lock()
+	healthy := ins.healthy
+	passed := ins.checksPassed
+	ins.mx.Unlock()
+	if !healthy || passed < 3 {
+		t.Fatalf("instance should be healthy after a few gRPC checks. Passed: %d\n", passed)
+	}
+	if n := listener.accepted.Load(); n != 1 {
+		t.Errorf("every check should go over the same connection. Connections: %d\n", n)
+	}
+
+	// Closed once the instance is no longer monitored
+	cancel()
+	<-stopped
+	if state := ins.grpcConn.GetState(); state != connectivity.Shutdown {
+		t.Errorf("connection should be closed with the monitor. State: %s\n", state)
+	}
+}
+
+func TestInstanceMonitorCheckType(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer listener.Close()
+
+	// Nothing speaks HTTP here - only a TCP check can pass
+	ins, err := NewInstance(fmt.Sprintf("http://%s;check=tcp", listener.Addr()))
+	if err != nil {
+		t.Fatal("NewInstance should not error here: ", err)
+	}
+	if ins.checkType != TCP_HEALTH_CHECK {
+		t.Fatalf("Expected check type: `tcp`, Actual: `%s`\n", ins.checkType)
+	}
+	ins.healthCheck, _ = newHealthCheck(Config{HealthCheckInterval: time.Millisecond * 50, HealthCheckTimeout: time.Millisecond * 200})
+	go ins.monitor(t.Context())
+
+	time.Sleep(time.Millisecond * 300)
+	ins.mx.Lock()
+	healthy := ins.healthy
+	ins.mx.Unlock()
+	if !healthy {
+		t.Error("instance should be healthy through its TCP check")
+	}
+
+	_, err = NewInstance("http://localhost:20000;check=udp")
+	if err == nil || !strings.HasPrefix(err.Error(), "[NewInstance] -> Invalid health check type.") {
+		t.Error("unknown check types should be rejected. Actual: ", err)
+	}
+}
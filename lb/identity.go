@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const DEFAULT_CLIENT_IDENTITY_HEADER = "X-Client-Identity"
+const DEFAULT_CLIENT_IDENTITY_FIELD = "cn"
+
+// Ways the listener treats client certificates
+const REQUIRE_CLIENT_AUTH = "require"
+const OPTIONAL_CLIENT_AUTH = "optional"
+
+type clientIdentityKey struct{}
+
+// Turns the verified certificate of a client into an identity. The identity
+// is forwarded to the instances in a header and can be routed on
+type clientIdentities struct {
+	header  string
+	field   string            // Part of the certificate the identity is taken from. See identityOf
+	mapping map[string]string // Optional. Renames the value taken from the certificate
+}
+
+// Parses the identity field and the mapping - comma separated `value=identity`
+// pairs. Eg: `spiffe://corp/billing=billing,spiffe://corp/search=search`
+func newClientIdentities(cfg Config) (*clientIdentities, error) {
+	ids := &clientIdentities{
+		header:  cfg.ClientIdentityHeader,
+		field:   cfg.TLSClientIdentity,
+		mapping: map[string]string{},
+	}
+	if ids.header == "" {
+		ids.header = DEFAULT_CLIENT_IDENTITY_HEADER
+	}
+	if ids.field == "" {
+		ids.field = DEFAULT_CLIENT_IDENTITY_FIELD
+	}
+	switch ids.field {
+	case "cn", "subject", "dns", "uri", "email":
+	default:
+		return nil, fmt.Errorf("[newClientIdentities] -> unknown identity field: `%s`. Expected `cn`, `subject`, `dns`, `uri` or `email`", ids.field)
+	}
+	for _, pair := range strings.Split(cfg.TLSClientIdentityMap, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		value, identity, ok := strings.Cut(pair, "=")
+		if !ok || value == "" || identity == "" {
+			return nil, fmt.Errorf("[newClientIdentities] -> invalid identity mapping: `%s`. Expected `value=identity`", pair)
+		}
+		ids.mapping[value] = identity
+	}
+	return ids, nil
+}
+
+// The identity of the client that presented `cert`. Values without a mapping
+// are used as they are. Empty if the certificate lacks the field
+func (ids *clientIdentities) identityOf(cert *x509.Certificate) string {
+	value := ""
+	switch ids.field {
+	case "cn":
+		value = cert.Subject.CommonName
+	case "subject":
+		value = cert.Subject.String()
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			value = cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			value = cert.URIs[0].String()
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			value = cert.EmailAddresses[0]
+		}
+	}
+	if identity, ok := ids.mapping[value]; ok {
+		return identity
+	}
+	return value
+}
+
+// Sets the identity header of every request through `next` to the identity of
+// its client certificate. Whatever the client sent in the header itself is
+// dropped, so instances can trust it
+func (ids *clientIdentities) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		req.Header.Del(ids.header)
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(res, req)
+			return
+		}
+		identity := ids.identityOf(req.TLS.VerifiedChains[0][0])
+		if identity == "" {
+			next.ServeHTTP(res, req)
+			return
+		}
+		req.Header.Set(ids.header, identity)
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), clientIdentityKey{}, identity)))
+	})
+}
+
+// Sets the identity of the client that sent `req` on `out`, the request to
+// the instance
+func (ids *clientIdentities) apply(out http.Header, req *http.Request) {
+	if ids == nil {
+		return
+	}
+	if identity := clientIdentity(req); identity != "" {
+		out.Set(ids.header, identity)
+	}
+}
+
+// Identity of the client that sent `req`. Empty for clients without a
+// verified certificate
+func clientIdentity(req *http.Request) string {
+	identity, _ := req.Context().Value(clientIdentityKey{}).(string)
+	return identity
+}
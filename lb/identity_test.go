@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNewClientIdentities(t *testing.T) {
+	ids, err := newClientIdentities(Config{})
+	if err != nil {
+		t.Fatal("newClientIdentities should not error here: ", err)
+	}
+	if ids.header != DEFAULT_CLIENT_IDENTITY_HEADER || ids.field != DEFAULT_CLIENT_IDENTITY_FIELD {
+		t.Errorf("defaults not applied. Actual: `%s` `%s`\n", ids.header, ids.field)
+	}
+
+	cases := []Config{
+		{TLSClientIdentity: "serial"},
+		{TLSClientIdentityMap: "billing"},
+		{TLSClientIdentityMap: "=billing"},
+	}
+	for _, cfg := range cases {
+		if _, err := newClientIdentities(cfg); err == nil {
+			t.Errorf("config should be rejected: %+v\n", cfg)
+		}
+	}
+	if _, err := NewLBWithConfig(t.Context(), Config{TLSClientIdentity: "serial"}); err == nil {
+		t.Error("NewLBWithConfig should error for an unknown identity field")
+	}
+}
+
+func TestClientIdentityOf(t *testing.T) {
+	uri, _ := url.Parse("spiffe://corp/billing")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "billing-7f9c", Organization: []string{"corp"}},
+		DNSNames:       []string{"billing.corp.internal", "billing"},
+		URIs:           []*url.URL{uri},
+		EmailAddresses: []string{"billing@corp.com"},
+	}
+	cases := map[string]string{
+		"cn":      "billing-7f9c",
+		"subject": "CN=billing-7f9c,O=corp",
+		"dns":     "billing.corp.internal",
+		"uri":     "spiffe://corp/billing",
+		"email":   "billing@corp.com",
+	}
+	for field, expected := range cases {
+		ids, _ := newClientIdentities(Config{TLSClientIdentity: field})
+		if actual := ids.identityOf(cert); actual != expected {
+			t.Errorf("`%s` - Expected: `%s`. Actual: `%s`\n", field, expected, actual)
+		}
+	}
+
+	ids, _ := newClientIdentities(Config{TLSClientIdentity: "uri", TLSClientIdentityMap: "spiffe://corp/billing=billing, spiffe://corp/search=search"})
+	if actual := ids.identityOf(cert); actual != "billing" {
+		t.Errorf("mapped identity Expected: `billing`. Actual: `%s`\n", actual)
+	}
+	if actual := ids.identityOf(&x509.Certificate{}); actual != "" {
+		t.Errorf("certificate without the field should have no identity. Actual: `%s`\n", actual)
+	}
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.Header.Get(DEFAULT_CLIENT_IDENTITY_HEADER)))
+	}))
+	defer upstream.Close()
+
+	ca := newTestCA(t)
+	clientCA := newTestCA(t)
+	clientCert, _, _ := clientCA.issue(t, "billing")
+	strangerCert, _, _ := newTestCA(t).issue(t, "stranger")
+
+	for _, mode := range []string{REQUIRE_CLIENT_AUTH, OPTIONAL_CLIENT_AUTH} {
+		cfg := Config{
+			InstanceList:    upstream.URL,
+			TLSCerts:        writeTestCertPair(t, ca, "lb", "lb.example.com"),
+			TLSClientCAFile: writeTestFile(t, "client-ca.pem", clientCA.pem),
+			TLSClientAuth:   mode,
+			// The identity is the LB's own, not held back by rules for the client's headers
+			HeaderRules: "/ request-allow=Accept",
+		}.withDefaults()
+		var err error
+		G_LB, err = NewLBWithConfig(t.Context(), cfg)
+		if err != nil {
+			t.Fatal("NewLB should not error here: ", err)
+		}
+		G_LB.instances[0].healthy = true
+		mux := http.NewServeMux()
+		router(mux)
+		server, err := newServer(t.Context(), cfg, G_LB.identities.handler(mux))
+		if err != nil {
+			t.Fatal("newServer should not error here: ", err)
+		}
+		addr := serveTLS(t, server)
+
+		get := func(certs ...tls.Certificate) (string, error) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      ca.pool(),
+				ServerName:   "lb.example.com",
+				Certificates: certs,
+			}}}
+			req, _ := http.NewRequest(http.MethodGet, "https://"+addr+"/", nil)
+			req.Header.Set(DEFAULT_CLIENT_IDENTITY_HEADER, "admin")
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return string(body), nil
+		}
+
+		// The identity of the certificate replaces whatever the client claims
+		if identity, err := get(clientCert); err != nil || identity != "billing" {
+			t.Errorf("%s - Expected identity `billing`. Actual: `%s` (err: %v)\n", mode, identity, err)
+		}
+		if _, err := get(strangerCert); err == nil {
+			t.Errorf("%s - certificate from an unknown CA should be rejected\n", mode)
+		}
+		identity, err := get()
+		switch mode {
+		case REQUIRE_CLIENT_AUTH:
+			if err == nil {
+				t.Error("client without a certificate should be rejected")
+			}
+		case OPTIONAL_CLIENT_AUTH:
+			if err != nil || identity != "" {
+				t.Errorf("client without a certificate should get through without an identity. Actual: `%s` (err: %v)\n", identity, err)
+			}
+		}
+	}
+
+	// Client certificates need the listener to terminate TLS
+	cases := []Config{
+		{TLSClientCAFile: writeTestFile(t, "client-ca.pem", clientCA.pem)},
+		{TLSCerts: writeTestCertPair(t, ca, "lb"), TLSClientCAFile: writeTestFile(t, "client-ca.pem", clientCA.pem), TLSClientAuth: "sometimes"},
+		{TLSCerts: writeTestCertPair(t, ca, "lb"), TLSClientCAFile: "/does/not/exist.pem"},
+	}
+	for _, cfg := range cases {
+		if _, err := newServer(t.Context(), cfg.withDefaults(), http.NotFoundHandler()); err == nil {
+			t.Errorf("config should be rejected: %+v\n", cfg)
+		}
+	}
+}
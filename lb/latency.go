@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Relative error of every percentile read from a latency sketch
+const LATENCY_SKETCH_ACCURACY = 0.01
+
+// Latencies above this all land in the last bucket
+const LATENCY_SKETCH_MAX = time.Hour
+
+// Bucket i of a sketch holds latencies in (gamma^(i-1), gamma^i] microseconds,
+// so every bucket is at most LATENCY_SKETCH_ACCURACY off its contents
+var latencySketchGamma = (1 + LATENCY_SKETCH_ACCURACY) / (1 - LATENCY_SKETCH_ACCURACY)
+var latencySketchBuckets = latencyBucket(float64(LATENCY_SKETCH_MAX/time.Microsecond)) + 1
+
+func latencyBucket(micros float64) int {
+	if micros <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log(micros) / math.Log(latencySketchGamma)))
+}
+
+// Streaming latency sketch with microsecond precision - a log bucketed
+// histogram (like DDSketch or HDR histogram) where older samples count for
+// less. A sample's weight halves every `halfLife`, so percentiles follow
+// changes in latency without keeping any samples around.
+// Weights are kept relative to a landmark time (forward decay) so that only
+// the bucket of a new sample has to be touched when recording it
+type latencySketch struct {
+	mx       sync.Mutex
+	halfLife time.Duration
+	counts   []float64 // Decayed sample weights per bucket
+	total    float64   // Sum of counts
+	sum      float64   // Decayed sum of samples in microseconds, for the mean
+	landmark time.Time
+	lastAt   time.Time // When the last sample was recorded
+}
+
+func newLatencySketch(halfLife time.Duration) *latencySketch {
+	return &latencySketch{halfLife: halfLife}
+}
+
+// Weight of a sample taken at `now` relative to the landmark
+func (s *latencySketch) weight(now time.Time) float64 {
+	return math.Exp2(float64(now.Sub(s.landmark)) / float64(s.halfLife))
+}
+
+func (s *latencySketch) record(now time.Time, d time.Duration) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.counts == nil {
+		s.counts = make([]float64, latencySketchBuckets)
+		s.landmark = now
+	}
+	// Move the landmark forward before weights get out of float range
+	if now.Sub(s.landmark) > s.halfLife*64 {
+		scale := 1 / s.weight(now)
+		for i := range s.counts {
+			s.counts[i] *= scale
+		}
+		s.total *= scale
+		s.sum *= scale
+		s.landmark = now
+	}
+
+	micros := float64(d) / float64(time.Microsecond)
+	w := s.weight(now)
+	s.counts[min(latencyBucket(micros), latencySketchBuckets-1)] += w
+	s.total += w
+	s.sum += w * micros
+	s.lastAt = now
+}
+
+// Latency below which a fraction `q` of the samples lie. False when there are
+// no samples
+func (s *latencySketch) quantile(q float64) (time.Duration, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.total == 0 {
+		return 0, false
+	}
+	target := q * s.total
+	seen := 0.0
+	i := 0
+	for ; i < len(s.counts)-1; i++ {
+		seen += s.counts[i]
+		if seen >= target {
+			break
+		}
+	}
+	// Middle of the bucket, so the estimate is off by at most the accuracy
+	micros := 2 * math.Pow(latencySketchGamma, float64(i)) / (latencySketchGamma + 1)
+	return time.Duration(micros * float64(time.Microsecond)), true
+}
+
+// Decayed mean latency. False when there are no samples
+func (s *latencySketch) mean() (time.Duration, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.total == 0 {
+		return 0, false
+	}
+	return time.Duration(s.sum / s.total * float64(time.Microsecond)), true
+}
+
+// Forgets all samples if none have been recorded for `idle`. An instance that
+// is taken out of the pool for being slow receives no requests that could
+// bring its latency down again, so this is what lets it back in
+func (s *latencySketch) expire(now time.Time, idle time.Duration) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.total == 0 || now.Sub(s.lastAt) <= idle {
+		return
+	}
+	clear(s.counts)
+	s.total = 0
+	s.sum = 0
+	s.landmark = now
+}
+
+// Decides when an instance is too slow to be available and how its latency
+// sketch behaves
+type latencyPolicy struct {
+	percentile float64 // 0-100
+	threshold  time.Duration
+	halfLife   time.Duration
+	idleReset  time.Duration
+}
+
+const DEFAULT_LATENCY_PERCENTILE = 50.0
+const DEFAULT_LATENCY_THRESHOLD = time.Millisecond * 10
+const DEFAULT_LATENCY_HALF_LIFE = time.Second * 10
+const DEFAULT_LATENCY_IDLE_RESET = time.Second * 5
+
+func defaultLatencyPolicy() *latencyPolicy {
+	lp, _ := newLatencyPolicy(Config{})
+	return lp
+}
+
+func newLatencyPolicy(cfg Config) (*latencyPolicy, error) {
+	cfg = cfg.withDefaults()
+	if cfg.LatencyPercentile > 100 {
+		return nil, fmt.Errorf("[newLatencyPolicy] -> invalid percentile: `%g`. Expected a value between 0 and 100", cfg.LatencyPercentile)
+	}
+	return &latencyPolicy{
+		percentile: cfg.LatencyPercentile,
+		threshold:  cfg.LatencyThreshold,
+		halfLife:   cfg.LatencyHalfLife,
+		idleReset:  cfg.LatencyIdleReset,
+	}, nil
+}
+
+// Whether the configured percentile of `s` is above the threshold
+func (lp *latencyPolicy) exceededBy(s *latencySketch) bool {
+	if lp == nil || s == nil {
+		return false
+	}
+	latency, ok := s.quantile(lp.percentile / 100)
+	return ok && latency > lp.threshold
+}
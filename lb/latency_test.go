@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencySketchQuantiles(t *testing.T) {
+	s := newLatencySketch(time.Second * 10)
+	if _, ok := s.quantile(0.5); ok {
+		t.Fatal("empty sketch should have no quantiles")
+	}
+
+	now := time.Now()
+	for i := 1; i <= 1000; i++ {
+		s.record(now, time.Duration(i)*time.Microsecond)
+	}
+	cases := map[float64]time.Duration{
+		0.5:  time.Microsecond * 500,
+		0.9:  time.Microsecond * 900,
+		0.99: time.Microsecond * 990,
+	}
+	for q, expected := range cases {
+		got, ok := s.quantile(q)
+		if !ok {
+			t.Fatal("sketch should have quantiles")
+		}
+		if diff := float64(got-expected) / float64(expected); diff < -LATENCY_SKETCH_ACCURACY*1.5 || diff > LATENCY_SKETCH_ACCURACY*1.5 {
+			t.Errorf("quantile %v. Expected about: %s. Actual: %s", q, expected, got)
+		}
+	}
+
+	// Latencies past the largest bucket still count
+	s.record(now, time.Hour*2)
+	if got, _ := s.quantile(1); got < time.Minute*59 {
+		t.Error("largest latency should land in the last bucket: ", got)
+	}
+}
+
+func TestLatencySketchDecay(t *testing.T) {
+	s := newLatencySketch(time.Second)
+	now := time.Now()
+	for range 100 {
+		s.record(now, time.Millisecond*100)
+	}
+	// 10 half lives later a handful of fast samples outweighs all of them
+	later := now.Add(time.Second * 10)
+	for range 10 {
+		s.record(later, time.Millisecond)
+	}
+	if got, _ := s.quantile(0.5); got > time.Millisecond*2 {
+		t.Error("old samples should have decayed away. p50: ", got)
+	}
+
+	// The landmark moving forward keeps weights in range
+	muchLater := now.Add(time.Hour)
+	s.record(muchLater, time.Millisecond*3)
+	if got, ok := s.quantile(0.5); !ok || got < time.Microsecond*2900 || got > time.Microsecond*3100 {
+		t.Error("latest sample should dominate after an hour. p50: ", got)
+	}
+	if mean, _ := s.mean(); mean < time.Microsecond*2900 || mean > time.Microsecond*3100 {
+		t.Error("latest sample should dominate the mean after an hour: ", mean)
+	}
+}
+
+func TestLatencySketchExpire(t *testing.T) {
+	s := newLatencySketch(time.Second * 10)
+	now := time.Now()
+	s.record(now, time.Millisecond*50)
+
+	s.expire(now.Add(time.Second*4), time.Second*5)
+	if _, ok := s.quantile(0.5); !ok {
+		t.Error("sketch should not be reset before it has been idle long enough")
+	}
+	s.expire(now.Add(time.Second*6), time.Second*5)
+	if _, ok := s.quantile(0.5); ok {
+		t.Error("sketch should be reset after being idle")
+	}
+}
+
+func TestNewLatencyPolicy(t *testing.T) {
+	lp, err := newLatencyPolicy(Config{LatencyPercentile: 99, LatencyThreshold: time.Millisecond * 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newLatencySketch(lp.halfLife)
+	for range 98 {
+		s.record(time.Now(), time.Millisecond)
+	}
+	if lp.exceededBy(s) {
+		t.Error("p99 is below the threshold")
+	}
+	s.record(time.Now(), time.Second)
+	s.record(time.Now(), time.Second)
+	if !lp.exceededBy(s) {
+		t.Error("p99 is above the threshold")
+	}
+
+	if _, err := newLatencyPolicy(Config{LatencyPercentile: 101}); err == nil {
+		t.Error("percentile above 100 should be rejected")
+	}
+}
@@ -2,143 +2,490 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
 type Instance struct {
-	mx                   sync.Mutex
-	url                  string
-	avgResponseTimeMilli float64
-	responseTimeCache    []int64 // Store a window of response times to create average
-	lastResponseAt       int64
-	healthy              bool
-	cancelFunc           context.CancelFunc
+	mx            sync.Mutex
+	url           string
+	weight        int          // Relative share of traffic used by weighted balancers
+	inFlight      atomic.Int64 // Requests currently being proxied to the instance
+	breaker       *circuitBreaker
+	ejectedUntil  atomic.Int64 // Unix nano time until which outlier detection keeps the instance out of the pool
+	healthCheck   *healthCheck
+	checkType     string // How the instance is health checked. See healthCheck.check
+	slowStart     *slowStart
+	healthySince  atomic.Int64      // Unix nano time the instance last turned healthy
+	checked       bool              // Whether a health check has completed yet
+	checksPassed  int               // Health checks passed in a row
+	checksFailed  int               // Health checks failed in a row
+	transport     http.RoundTripper // Shared by all requests to the instance
+	h1Transport   http.RoundTripper // HTTP/1.1 only, for upgrades to `h2` and `h2c` instances. See Instance.transportFor
+	flushInterval time.Duration     // How often streamed responses are flushed. See flushWriter
+	headerPolicy  *headerPolicy     // Headers passed on per route
+	serverName    string            // Overrides the TLS server name of the instance
+	protocol      string            // HTTP version spoken to the instance. See NewInstance
+	upgrades      upgradedConns     // Connections that switched protocols, eg. WebSockets
+	upgradeDrain  time.Duration     // Time upgraded connections get to finish once the instance is removed
+	grpcConn      *grpc.ClientConn  // Kept open for gRPC health checks while the instance is monitored
+	forwarding    *forwarding
+	requestIDs    *requestIDs
+	identities    *clientIdentities
+	latency       *latencySketch
+	latencyPolicy *latencyPolicy
+	healthy       bool
+	cancelFunc    context.CancelFunc
 }
 
-func NewInstance(urlString string) (*Instance, error) {
-	urlAddr, err := url.Parse(urlString)
+// Creates an instance from a spec of the form `<url>[;<option>=<value>...]`.
+// Supported options:
+//   - weight: positive integer share of traffic for weighted balancers. Default 1
+//   - check: health check type. One of `http`, `tcp` or `grpc`. Default `http`
+//   - sni: server name sent and verified in the TLS handshake with `https` instances
+//   - proto: HTTP version spoken to the instance. `http1`, `h2` for `https`
+//     instances or `h2c` - HTTP/2 without TLS - for `http` ones. Default `http1`
+func NewInstance(spec string) (*Instance, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ";")
+	urlAddr, err := url.Parse(strings.TrimSpace(parts[0]))
 	if err != nil {
 		return nil, fmt.Errorf("[NewInstance] -> malformed url: %s", err.Error())
 	}
 
-	if urlAddr.Scheme != "http" {
-		return nil, fmt.Errorf("[NewInstance] -> Invalid url protocol. Expected: `http`. Actual: `%s`", urlAddr.Scheme)
+	if urlAddr.Scheme != "http" && urlAddr.Scheme != "https" {
+		return nil, fmt.Errorf("[NewInstance] -> Invalid url protocol. Expected: `http` or `https`. Actual: `%s`", urlAddr.Scheme)
+	}
+	ins := &Instance{
+		url:           fmt.Sprintf("%s://%s", urlAddr.Scheme, urlAddr.Host),
+		weight:        1,
+		healthCheck:   defaultHealthCheck(),
+		checkType:     HTTP_HEALTH_CHECK,
+		protocol:      HTTP1_PROTOCOL,
+		upgradeDrain:  DEFAULT_UPGRADE_DRAIN_TIMEOUT,
+		transport:     defaultUpstreamTransport,
+		latency:       newLatencySketch(DEFAULT_LATENCY_HALF_LIFE),
+		latencyPolicy: defaultLatencyPolicy(),
+	}
+
+	for _, option := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		switch strings.TrimSpace(key) {
+		case "weight":
+			weight, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("[NewInstance] -> Invalid weight. Expected a positive integer. Actual: `%s`", value)
+			}
+			ins.weight = weight
+		case "check":
+			checkType := strings.TrimSpace(value)
+			if !validHealthCheckType(checkType) {
+				return nil, fmt.Errorf("[NewInstance] -> Invalid health check type. Expected one of `http`, `tcp` or `grpc`. Actual: `%s`", value)
+			}
+			ins.checkType = checkType
+		case "sni":
+			serverName := strings.TrimSpace(value)
+			if urlAddr.Scheme != "https" || serverName == "" {
+				return nil, fmt.Errorf("[NewInstance] -> Invalid server name. Expected a host name for an `https` instance. Actual: `%s`", value)
+			}
+			ins.serverName = serverName
+		case "proto":
+			protocol := strings.TrimSpace(value)
+			if !validProtocol(protocol, urlAddr.Scheme) {
+				return nil, fmt.Errorf("[NewInstance] -> Invalid protocol. Expected `http1`, `h2` for an `https` instance or `h2c` for an `http` one. Actual: `%s`", value)
+			}
+			ins.protocol = protocol
+		case "":
+		default:
+			return nil, fmt.Errorf("[NewInstance] -> Unknown instance option: `%s`", key)
+		}
 	}
-	return &Instance{
-		url: fmt.Sprintf("%s://%s", urlAddr.Scheme, urlAddr.Host),
-	}, nil
+	if ins.protocol != HTTP1_PROTOCOL {
+		ins.transport = withProtocol(defaultUpstreamTransport, ins.protocol)
+		ins.h1Transport = withProtocol(defaultUpstreamTransport, HTTP1_PROTOCOL)
+	}
+	return ins, nil
 }
 
 func (ins *Instance) monitor(ctx context.Context) {
-	tc := time.NewTicker(time.Second * 1)   // Check instance health every second
-	tAvg := time.NewTicker(time.Second * 2) // Calculate response time average every 2 seconds
+	tc := time.NewTimer(ins.healthCheck.next()) // Check instance health every interval
+	tLatency := time.NewTicker(time.Second * 2) // Report latency every 2 seconds
+	defer func() {
+		if ins.grpcConn != nil {
+			ins.grpcConn.Close()
+		}
+	}()
 	for {
 		select {
 		case <-ctx.Done():
+			// The instance was removed or the LB is shutting down
+			ins.upgrades.drain(ins.upgradeDrain)
 			return
 		case <-tc.C:
-			client := http.Client{Timeout: time.Millisecond * 10}
-			_, err := client.Get(fmt.Sprintf("%s/health", ins.url))
-			if err != nil {
-				time.Sleep(time.Millisecond * 100)
-				_, err = client.Get(fmt.Sprintf("%s/health", ins.url))
-				if err != nil {
-					ins.mx.Lock()
-					ins.healthy = false
-					ins.mx.Unlock()
-				}
-			} else {
-				ins.mx.Lock()
-				ins.healthy = true
-				ins.mx.Unlock()
+			err := ins.checkHealth(ctx)
+			if ctx.Err() != nil {
+				ins.upgrades.drain(ins.upgradeDrain)
+				return
 			}
-		case <-tAvg.C:
-			if (time.Now().UnixMilli() - ins.lastResponseAt) > 5*1000 { // Every 5+ seconds allow the server to be called again
-				ins.mx.Lock()
-				ins.avgResponseTimeMilli = 0
-				ins.responseTimeCache = []int64{}
-				ins.mx.Unlock()
+			ins.recordHealthCheck(err)
+			tc.Reset(ins.healthCheck.next())
+		case <-tLatency.C:
+			ins.latency.expire(time.Now(), ins.latencyPolicy.idleReset)
+			mean, _ := ins.latency.mean()
+			RESPONSE_DURATION_METRIC.WithLabelValues(ins.url).Set(float64(mean) / float64(time.Millisecond))
+			for _, q := range LATENCY_QUANTILES {
+				latency, _ := ins.latency.quantile(q)
+				RESPONSE_LATENCY_METRIC.WithLabelValues(ins.url, strconv.FormatFloat(q, 'f', -1, 64)).Set(float64(latency.Microseconds()))
 			}
+		}
+	}
+}
 
-			if len(ins.responseTimeCache) > 0 {
-				sum := int64(0)
-				ins.mx.Lock()
-				for _, v := range ins.responseTimeCache {
-					sum += v
-				}
-				ins.avgResponseTimeMilli = float64(sum) / float64(len(ins.responseTimeCache))
-				ins.mx.Unlock()
-			}
-			RESPONSE_DURATION_METRIC.WithLabelValues(ins.url).Set(ins.avgResponseTimeMilli)
+// Runs a health check against the instance. gRPC checks share one connection
+// rather than dialing for every check - the TLS and HTTP/2 handshakes wouldn't
+// fit in the check's timeout
+func (ins *Instance) checkHealth(ctx context.Context) error {
+	if ins.checkType == GRPC_HEALTH_CHECK && ins.grpcConn == nil {
+		conn, err := dialGRPC(ins.url, ins.transport)
+		if err != nil {
+			return err
+		}
+		ins.grpcConn = conn
+	}
+	return ins.healthCheck.checkOver(ctx, ins.checkType, ins.url, ins.transport, ins.grpcConn)
+}
+
+// Updates the instance's health with the result of a health check. The very
+// first result is taken as is. After that it takes `rise` passing checks in a
+// row to become healthy and `fall` failing ones to become unhealthy
+func (ins *Instance) recordHealthCheck(err error) {
+	ins.mx.Lock()
+	defer ins.mx.Unlock()
+
+	healthy := ins.healthy
+	if err == nil {
+		ins.checksPassed += 1
+		ins.checksFailed = 0
+		if !ins.checked || ins.checksPassed >= ins.healthCheck.rise {
+			healthy = true
 		}
+	} else {
+		ins.checksFailed += 1
+		ins.checksPassed = 0
+		if !ins.checked || ins.checksFailed >= ins.healthCheck.fall {
+			healthy = false
+		}
+	}
+	ins.checked = true
 
+	if healthy != ins.healthy {
+		if healthy {
+			ins.healthySince.Store(time.Now().UnixNano())
+			log.Printf("[Instance.recordHealthCheck] -> `%s` is healthy\n", ins.url)
+		} else {
+			log.Printf("[Instance.recordHealthCheck] -> `%s` is unhealthy: %s\n", ins.url, err)
+		}
+		ins.healthy = healthy
 	}
 }
 
-func (ins *Instance) isAvailable() bool {
-	if ins.avgResponseTimeMilli > 10 {
+// An instance is healthy as long as its health checks pass, its circuit
+// breaker lets requests through and it hasn't been ejected as an outlier
+func (ins *Instance) isHealthy() bool {
+	now := time.Now()
+	if ins.isEjected(now) {
+		return false
+	}
+	if ins.breaker != nil && !ins.breaker.ready(now) {
 		return false
 	}
-
 	return ins.healthy
 }
 
-func (ins *Instance) logResponseTime(start, end int64) {
-	ins.mx.Lock()
-	defer ins.mx.Unlock()
+// Fraction of its weight the instance gets while in slow start. 1 otherwise
+func (ins *Instance) slowStartFactor(now time.Time) float64 {
+	since := ins.healthySince.Load()
+	if ins.slowStart == nil || since == 0 {
+		return 1
+	}
+	return ins.slowStart.factor(now.Sub(time.Unix(0, since)))
+}
+
+// Weight of the instance with slow start taken into account
+func (ins *Instance) effectiveWeight(now time.Time) float64 {
+	return float64(ins.weight) * ins.slowStartFactor(now)
+}
+
+func (ins *Instance) isEjected(now time.Time) bool {
+	return now.UnixNano() < ins.ejectedUntil.Load()
+}
 
-	ins.responseTimeCache = append(ins.responseTimeCache, (end - start))
-	if len(ins.responseTimeCache) > 20 {
-		ins.responseTimeCache = ins.responseTimeCache[1:]
+// Latency below which a fraction `q` of the instance's requests completed. 0
+// when there is nothing to go by
+func (ins *Instance) latencyPercentile(q float64) time.Duration {
+	if ins.latency == nil {
+		return 0
 	}
-	ins.lastResponseAt = end
+	latency, _ := ins.latency.quantile(q)
+	return latency
+}
+
+// An available instance is healthy and not too slow
+func (ins *Instance) isAvailable() bool {
+	if ins.latencyPolicy.exceededBy(ins.latency) {
+		return false
+	}
+
+	return ins.isHealthy()
 }
 
-func (ins *Instance) jsonHandler(res http.ResponseWriter, req *http.Request) error {
-	start := time.Now().UnixMilli()
-	// call the associated responder service
-	client := http.Client{Timeout: time.Second * 200}
-	resp, err := client.Post(fmt.Sprintf("%s/json", ins.url), "application/json", req.Body)
-	end := time.Now().UnixMilli()
+func (ins *Instance) logResponseTime(start, end time.Time) {
+	if ins.latency == nil {
+		return
+	}
+	ins.latency.record(end, end.Sub(start))
+}
+
+// Response body that marks the request as no longer in flight once closed
+type inFlightBody struct {
+	io.ReadCloser
+	once sync.Once
+	ins  *Instance
+}
+
+func (b *inFlightBody) Close() error {
+	b.once.Do(func() { b.ins.inFlight.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+// Sends the request to the instance and returns its response without relaying
+// it. The request stays in flight until the response body is closed
+func (ins *Instance) roundTrip(req *http.Request) (*http.Response, error) {
+	outReq, err := http.NewRequestWithContext(withConnTrace(req.Context(), ins.url), req.Method, ins.url+req.URL.RequestURI(), req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("[Instance.roundTrip] -> Error creating upstream request: %s", err)
+	}
+	if req.ContentLength == 0 {
+		outReq.Body = http.NoBody
+	}
+	outReq.ContentLength = req.ContentLength
+	outReq.Header = req.Header.Clone()
+	if outReq.Header == nil {
+		outReq.Header = http.Header{}
+	}
+	removeHopHeaders(outReq.Header)
+	// Header rules apply to what the client sent, not to what the LB adds
+	ins.headerPolicy.ruleFor(req.URL.Path).filterRequest(outReq.Header)
+	ins.forwarding.apply(outReq.Header, req)
+	ins.requestIDs.apply(outReq.Header, req)
+	ins.identities.apply(outReq.Header, req)
+	propagateGRPCDeadline(outReq.Header, req)
+	// Upgrades are hop-by-hop as well, but passed on so that the instance can
+	// switch protocols. See Instance.splice
+	if upgrade := upgradeType(req.Header); upgrade != "" {
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", upgrade)
+	}
+	// `TE: trailers` is the one hop-by-hop value passed on. It tells the
+	// instance that trailers make it through, which gRPC relies on
+	if slices.Contains(headerTokens(req.Header.Values("Te")), "trailers") {
+		outReq.Header.Set("Te", "trailers")
+	}
+	outReq.Trailer = req.Trailer
+
+	ins.inFlight.Add(1)
+	start := time.Now()
+	// call the associated instance. Redirects are relayed to the client as is.
+	// There is no overall timeout so that long lived streams aren't cut off -
+	// the request is cancelled when the client goes away instead
+	client := http.Client{
+		Transport: ins.transportFor(req),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(outReq)
+	end := time.Now()
 
-	// Log avg response time in go routine so as to not block the response
+	// Log response time in go routine so as to not block the response
 	go ins.logResponseTime(start, end)
 
 	if err != nil {
-		return fmt.Errorf("[Instance.jsonHandler] -> Error calling responder: %s", err)
+		ins.inFlight.Add(-1)
+		// Wrapped so that retry policies can tell connect failures apart and
+		// cancellations aren't held against the instance
+		return nil, fmt.Errorf("[Instance.roundTrip] -> Error calling instance: %w", err)
+	}
+	UPSTREAM_PROTOCOL_METRIC.WithLabelValues(ins.url, resp.Proto).Inc()
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, ins: ins}
+	return resp, nil
+}
+
+// Transport `req` is sent to the instance with. HTTP/2 has no way of
+// switching protocols, so upgrades always go over HTTP/1.1
+func (ins *Instance) transportFor(req *http.Request) http.RoundTripper {
+	if ins.h1Transport != nil && upgradeType(req.Header) != "" {
+		return ins.h1Transport
+	}
+	return ins.transport
+}
+
+// Relays the status, headers, body and trailers of `resp` to `res` and closes
+// its body
+func (ins *Instance) writeResponse(res http.ResponseWriter, req *http.Request, resp *http.Response) {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		ins.splice(res, req, resp)
+		return
+	}
+
+	rule := ins.headerPolicy.ruleFor(req.URL.Path)
+	removeHopHeaders(resp.Header)
+	rule.filterResponse(resp.Header)
+	rule.filterResponse(resp.Trailer)
+	copyHeader(res.Header(), resp.Header)
+
+	// Announce trailers so that they can be set once the body has been copied
+	announced := make(map[string]bool, len(resp.Trailer))
+	if len(resp.Trailer) > 0 {
+		keys := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			keys = append(keys, k)
+			announced[k] = true
+		}
+		res.Header().Add("Trailer", strings.Join(keys, ", "))
 	}
 
 	res.WriteHeader(resp.StatusCode)
 	RESPONSE_STATUS_METRIC.WithLabelValues(fmt.Sprintf("%d", resp.StatusCode)).Inc()
-	if resp.StatusCode != http.StatusOK {
-		return nil
+	logRequest(req, "[Instance.writeResponse] -> %s %s responding with %d from: `%s`\n", req.Method, req.URL.Path, resp.StatusCode, ins.url)
+
+	var body io.Writer = res
+	if interval := flushIntervalFor(resp, ins.flushInterval); interval != 0 {
+		fw := newFlushWriter(res, interval)
+		defer fw.stop()
+		body = fw
+		if interval < 0 {
+			// Let the client know the stream has started before the first event
+			http.NewResponseController(res).Flush()
+		}
+	}
+	// Stops as soon as either side goes away. A client going away cancels the
+	// request to the instance through its context
+	if _, err := io.Copy(body, resp.Body); err != nil {
+		logRequest(req, "[Instance.writeResponse] -> error copying response body from `%s`: %s\n", ins.url, err)
+		return
+	}
+
+	// resp.Trailer is only fully populated after the body has been read
+	rule.filterResponse(resp.Trailer)
+	for k, vv := range resp.Trailer {
+		if !announced[k] {
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range vv {
+			res.Header().Add(k, v)
+		}
 	}
-	log.Printf("[Instance.jsonHandler] -> responding from: `%s`\n", ins.url)
-	res.Header().Set("Content-Type", "application/json")
-	io.Copy(res, resp.Body)
-	return nil
 }
 
 type LB struct {
 	mx        sync.Mutex
 	instances []*Instance
-	current   int
+	balancer  Balancer
+	cfg       Config
 	Ctx       context.Context
+
+	retryPolicy *retryPolicy
+	retryBudget *retryBudget
+	outliers    *outlierDetector
+	healthCheck *healthCheck
+	slowStart   *slowStart
+	latency     *latencyPolicy
+	transport   *http.Transport // Pools connections to the instances
+	headers     *headerPolicy
+	forwarding  *forwarding
+	requestIDs  *requestIDs
+	identities  *clientIdentities
 }
 
 func NewLB(ctx context.Context, instanceURLList string) (*LB, error) { // arugument is a comma separated string
-	lb := &LB{Ctx: ctx}
-	if instanceURLList == "" {
+	return NewLBWithConfig(ctx, Config{InstanceList: instanceURLList})
+}
+
+func NewLBWithConfig(ctx context.Context, cfg Config) (*LB, error) {
+	cfg = cfg.withDefaults()
+	balancer, err := NewBalancer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	retryPolicy, err := newRetryPolicy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	healthCheck, err := newHealthCheck(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	latency, err := newLatencyPolicy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	headers, err := newHeaderPolicy(cfg.HeaderRules)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	forwarding, err := newForwarding(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	requestIDs, err := newRequestIDs(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	identities, err := newClientIdentities(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	tlsConfig, err := newUpstreamTLSConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
+	}
+	transport := newUpstreamTransport(cfg, tlsConfig)
+	healthCheck.transport = transport
+	lb := &LB{
+		Ctx:         ctx,
+		healthCheck: healthCheck,
+		balancer:    balancer,
+		cfg:         cfg,
+		retryPolicy: retryPolicy,
+		retryBudget: newRetryBudget(cfg.RetryBudgetRatio, cfg.RetryBudgetMinPerSecond),
+		outliers:    newOutlierDetector(cfg),
+		slowStart:   newSlowStart(cfg),
+		latency:     latency,
+		transport:   transport,
+		headers:     headers,
+		forwarding:  forwarding,
+		requestIDs:  requestIDs,
+		identities:  identities,
+	}
+	go lb.outliers.run(ctx, lb.Instances)
+	if cfg.InstanceList == "" {
 		return lb, nil
 	}
-	instanceURLArr := strings.Split(instanceURLList, ",")
+	instanceURLArr := strings.Split(cfg.InstanceList, ",")
 	for _, instanceURL := range instanceURLArr {
 		if err := lb.AddInstance(instanceURL); err != nil {
 			return nil, fmt.Errorf("[NewLB] -> %s", err.Error())
@@ -147,15 +494,61 @@ func NewLB(ctx context.Context, instanceURLList string) (*LB, error) { // arugum
 	return lb, nil
 }
 
+// Returns the balancer in use. LBs created without one use the default
+// round robin balancer.
+// Must be called with lb.mx held
+func (lb *LB) getBalancer() Balancer {
+	if lb.balancer == nil {
+		lb.balancer, _ = NewBalancer(Config{Balancer: DEFAULT_BALANCER})
+		for _, ins := range lb.instances {
+			lb.balancer.Add(ins)
+		}
+	}
+	return lb.balancer
+}
+
 func (lb *LB) AddInstance(url string) error {
 	instance, err := NewInstance(url)
 	if err != nil {
 		return fmt.Errorf("[LB.AddInstance] -> %s", err.Error())
 	}
+	if lb.healthCheck != nil {
+		instance.healthCheck = lb.healthCheck
+	}
+	instance.slowStart = lb.slowStart
+	if lb.transport != nil {
+		transport := lb.transport
+		if instance.serverName != "" {
+			transport = withServerName(transport, instance.serverName)
+		}
+		instance.transport = transport
+		if instance.protocol != HTTP1_PROTOCOL {
+			instance.transport = withProtocol(transport, instance.protocol)
+			instance.h1Transport = withProtocol(transport, HTTP1_PROTOCOL)
+		}
+	}
+	instance.flushInterval = lb.cfg.FlushInterval
+	instance.upgradeDrain = lb.cfg.UpgradeDrainTimeout
+	instance.headerPolicy = lb.headers
+	instance.forwarding = lb.forwarding
+	instance.requestIDs = lb.requestIDs
+	instance.identities = lb.identities
+	if lb.latency != nil {
+		instance.latencyPolicy = lb.latency
+		instance.latency = newLatencySketch(lb.latency.halfLife)
+	}
+	instance.breaker = newCircuitBreaker(lb.cfg.withDefaults(), func(state breakerState) {
+		log.Printf("[circuitBreaker] -> `%s` is now %s\n", instance.url, state)
+		BREAKER_STATE_METRIC.WithLabelValues(instance.url).Set(float64(state))
+		BREAKER_TRANSITIONS_METRIC.WithLabelValues(instance.url, state.String()).Inc()
+	})
+	BREAKER_STATE_METRIC.WithLabelValues(instance.url).Set(float64(breakerClosed))
+
 	ctx, cancel := context.WithCancel(lb.Ctx)
 	lb.mx.Lock()
 	lb.instances = append(lb.instances, instance)
 	instance.cancelFunc = cancel
+	lb.getBalancer().Add(instance)
 	lb.mx.Unlock()
 	go instance.monitor(ctx)
 	return nil
@@ -178,40 +571,102 @@ func (lb *LB) RemoveInstance(url string) {
 		// cancel monitoring
 		instance.cancelFunc()
 		lb.instances = append(lb.instances[0:instanceIndex], lb.instances[instanceIndex+1:]...)
+		lb.getBalancer().Remove(instance)
+		// Instances with TLS or protocol settings of their own have a transport
+		// of their own. Nothing will use its idle connections again
+		for _, transport := range []http.RoundTripper{instance.transport, instance.h1Transport} {
+			if t, ok := transport.(*http.Transport); ok && t != lb.transport && t != defaultUpstreamTransport {
+				t.CloseIdleConnections()
+			}
+		}
 	}
 }
 
-// Round Robin - kinda!
-func (lb *LB) GetInstance() *Instance {
+// Returns a snapshot of the instances in the pool
+func (lb *LB) Instances() []*Instance {
 	lb.mx.Lock()
 	defer lb.mx.Unlock()
+	return slices.Clone(lb.instances)
+}
 
-	n := len(lb.instances)
-	checked := 0
+// Returns an available instance chosen by the balancer, or nil if there is none
+func (lb *LB) GetInstance() *Instance {
+	return lb.GetInstanceFor(nil)
+}
 
-	// This should never happen but oh well
-	if n == 0 {
-		return nil
+// Same as GetInstance but lets the balancer take `req` into account. Instances
+// in `exclude` are never returned
+func (lb *LB) GetInstanceFor(req *http.Request, exclude ...*Instance) *Instance {
+	lb.mx.Lock()
+	instances := make([]*Instance, 0, len(lb.instances))
+	for _, ins := range lb.instances {
+		if !slices.Contains(exclude, ins) {
+			instances = append(instances, ins)
+		}
 	}
+	balancer := lb.getBalancer()
+	lb.mx.Unlock()
 
-	// Start looking at available nodes from 1 + the last node used
-	// Increment by 1 until a node is found or we have checked all listed nodes
-	index := lb.current + 1
-	if index >= n {
-		index = 0
-	}
-	for checked < n {
-		checked += 1
-		if lb.instances[index].isAvailable() {
-			lb.current = index
-			return lb.instances[index]
+	_, selfPaced := balancer.(slowStartAware)
+	var deferred *Instance // First instance in slow start that was passed over
+	for len(instances) > 0 {
+		ins := balancer.Pick(instances, req)
+		if ins == nil {
+			break
 		}
-		index += 1
-		if index >= n {
-			index = 0
+		instances = slices.DeleteFunc(instances, func(i *Instance) bool { return i == ins })
+
+		// Instances in slow start only keep the share of picks their weight allows
+		now := time.Now()
+		if !selfPaced && rand.Float64() >= ins.slowStartFactor(now) {
+			if deferred == nil {
+				deferred = ins
+			}
+			continue
+		}
+
+		// A half-open breaker may have run out of trial requests since the pick
+		if ins.breaker == nil || ins.breaker.allow(now) {
+			return ins
 		}
 	}
 
-	// Return empty if no available node was found
+	// Better an instance in slow start than none at all
+	if deferred != nil && (deferred.breaker == nil || deferred.breaker.allow(time.Now())) {
+		return deferred
+	}
 	return nil
 }
+
+// Reports the outcome of a proxied request to the balancer, the instance's
+// circuit breaker and outlier detection. `status` is 0 if the instance could not
+// be reached
+func (lb *LB) Observe(ins *Instance, status int, duration time.Duration, err error) {
+	lb.mx.Lock()
+	balancer := lb.getBalancer()
+	lb.mx.Unlock()
+
+	// Requests abandoned by the client, or that ran out of the time it gave
+	// them, say nothing about the instance
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		lb.Abandon(ins)
+		return
+	}
+	balancer.Observe(ins, duration, err)
+	now := time.Now()
+	success := err == nil && status < 500
+	if ins.breaker != nil {
+		ins.breaker.record(now, success)
+	}
+	if lb.outliers != nil {
+		lb.outliers.observe(ins, lb.Instances(), now, success)
+	}
+}
+
+// For requests picked for `ins` whose outcome says nothing about it and won't
+// be observed
+func (lb *LB) Abandon(ins *Instance) {
+	if ins.breaker != nil {
+		ins.breaker.release(time.Now())
+	}
+}
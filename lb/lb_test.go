@@ -9,6 +9,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewInstanceValid(t *testing.T) {
@@ -38,11 +40,55 @@ func TestNewInstanceInvalid(t *testing.T) {
 		t.Fatal("method should have returned an error")
 	}
 
-	if !strings.HasPrefix(err.Error(), "[NewInstance] -> Invalid url protocol. Expected: `http`. Actual: ") {
+	if !strings.HasPrefix(err.Error(), "[NewInstance] -> Invalid url protocol. Expected: `http` or `https`. Actual: ") {
 		t.Error("Wrong error detected or error string has changed")
 	}
 }
 
+func TestNewInstanceOptions(t *testing.T) {
+	ins, err := NewInstance("http://localhost:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.weight != 1 {
+		t.Errorf("default weight should be 1. Actual: %d\n", ins.weight)
+	}
+
+	ins, err = NewInstance(" http://localhost:8000 ; weight=5 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.url != "http://localhost:8000" || ins.weight != 5 {
+		t.Errorf("Expected: `http://localhost:8000` with weight 5, Actual: `%s` with weight %d\n", ins.url, ins.weight)
+	}
+
+	for _, spec := range []string{"http://localhost:8000;weight=0", "http://localhost:8000;weight=abc"} {
+		_, err = NewInstance(spec)
+		if err == nil || !strings.HasPrefix(err.Error(), "[NewInstance] -> Invalid weight.") {
+			t.Errorf("`%s` should fail with an invalid weight error. Actual: %v\n", spec, err)
+		}
+	}
+
+	ins, err = NewInstance("http://localhost:8000;proto=h2c")
+	if err != nil || ins.protocol != H2C_PROTOCOL {
+		t.Errorf("Expected protocol `h2c`. Actual: `%s` (err: %v)\n", ins.protocol, err)
+	}
+	if ins.transport == defaultUpstreamTransport {
+		t.Error("h2c instance should get its own transport")
+	}
+	for _, spec := range []string{"http://localhost:8000;proto=h2", "https://localhost:8000;proto=h2c", "http://localhost:8000;proto=h3"} {
+		_, err = NewInstance(spec)
+		if err == nil || !strings.HasPrefix(err.Error(), "[NewInstance] -> Invalid protocol.") {
+			t.Errorf("`%s` should fail with an invalid protocol error. Actual: %v\n", spec, err)
+		}
+	}
+
+	_, err = NewInstance("http://localhost:8000;color=blue")
+	if err == nil || !strings.HasPrefix(err.Error(), "[NewInstance] -> Unknown instance option: ") {
+		t.Error("unknown options should be rejected. Actual: ", err)
+	}
+}
+
 func TestInstanceMonitor(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /health", func(res http.ResponseWriter, req *http.Request) {
@@ -68,31 +114,44 @@ func TestInstanceMonitor(t *testing.T) {
 		t.Error("faulty health check ticker. Server has started. Should be healthy by now")
 	}
 
-	ins.lastResponseAt = time.Now().UnixMilli()
-	ins.responseTimeCache = []int64{100, 200}
-	time.Sleep(time.Second * 2)
-	if ins.avgResponseTimeMilli != 150 {
-		t.Errorf("monitor is not calculating server response time average correctly. Actual: %v, Expected: 150\n", ins.avgResponseTimeMilli)
+	now := time.Now()
+	ins.latency.record(now, time.Millisecond*100)
+	ins.latency.record(now, time.Millisecond*200)
+	// Half a tick more than the 2 second latency ticker so the check never races it
+	time.Sleep(time.Millisecond * 2500)
+	if mean := testutil.ToFloat64(RESPONSE_DURATION_METRIC.WithLabelValues(ins.url)); mean < 149 || mean > 151 {
+		t.Errorf("monitor is not reporting server response time average correctly. Actual: %v, Expected: 150\n", mean)
+	}
+	if p99 := testutil.ToFloat64(RESPONSE_LATENCY_METRIC.WithLabelValues(ins.url, "0.99")); p99 < 198000 || p99 > 202000 {
+		t.Errorf("monitor is not reporting the p99 response time correctly. Actual: %v, Expected: 200000\n", p99)
 	}
 }
 
 func TestInstanceIsAvailable(t *testing.T) {
 	ins := Instance{
-		avgResponseTimeMilli: 10,
-		healthy:              false,
+		latency:       newLatencySketch(time.Second * 10),
+		latencyPolicy: defaultLatencyPolicy(),
+		healthy:       false,
 	}
+	ins.latency.record(time.Now(), time.Millisecond*9)
 	if ins.isAvailable() {
 		t.Error("healthy is `false`. isAvailable should return `false`. It returned `true`")
 	}
 
 	ins.healthy = true
 	if !ins.isAvailable() {
-		t.Error("healthy is true and avgResponseTimeMill is less than 100. isAvailable should return `true`. It returned `false`")
+		t.Error("healthy is true and median latency is less than 10ms. isAvailable should return `true`. It returned `false`")
 	}
 
-	ins.avgResponseTimeMilli = 101
+	ins.latency.record(time.Now(), time.Millisecond*101)
+	ins.latency.record(time.Now(), time.Millisecond*101)
 	if ins.isAvailable() {
-		t.Error("avgResponseTimeMilli is > 100. isAvailable should return `false`. It returned `true`")
+		t.Error("median latency is > 10ms. isAvailable should return `false`. It returned `true`")
+	}
+
+	ins.latencyPolicy = &latencyPolicy{percentile: 10, threshold: time.Millisecond * 10}
+	if !ins.isAvailable() {
+		t.Error("p10 latency is less than 10ms. isAvailable should return `true`. It returned `false`")
 	}
 }
 
@@ -102,72 +161,135 @@ func TestInstanceLogResponseTime(t *testing.T) {
 		t.Fatal("error creating new instance: ", err)
 	}
 
-	ins.logResponseTime(10, 20)
-	if len(ins.responseTimeCache) != 1 {
-		t.Error("response time was not appended to ins.responseTimeCache")
-	}
-
-	if ins.responseTimeCache[0] != 10 {
-		t.Error("response time was calculated incorrectly")
+	start := time.Now()
+	ins.logResponseTime(start, start.Add(time.Microsecond*1500))
+	if p50 := ins.latencyPercentile(0.5); p50 < time.Microsecond*1485 || p50 > time.Microsecond*1515 {
+		t.Error("response time was recorded incorrectly: ", p50)
 	}
 
-	for i := range 31 {
-		ins.logResponseTime(int64(i), int64(2*i+20))
+	// Older samples fade out
+	later := start.Add(time.Minute)
+	for i := range 100 {
+		ins.logResponseTime(later, later.Add(time.Duration(i)*time.Microsecond*50))
 	}
-
-	if len(ins.responseTimeCache) != 20 {
-		t.Error("responsetime window of 20 is not beiong maintained correctly")
-	}
-
-	if ins.responseTimeCache[19] != 50 {
-		t.Error("last value should be 50 not: ", ins.responseTimeCache[19])
+	if p50 := ins.latencyPercentile(0.5); p50 < time.Microsecond*2400 || p50 > time.Microsecond*2550 {
+		t.Error("p50 should be about 2.5ms not: ", p50)
 	}
-
-	if ins.responseTimeCache[0] != 31 {
-		t.Error("first value should be 31 not: ", ins.responseTimeCache[0])
+	if p99 := ins.latencyPercentile(0.99); p99 < time.Microsecond*4850 || p99 > time.Microsecond*5050 {
+		t.Error("p99 should be about 4.9ms not: ", p99)
 	}
 }
 
-func TestInstanceJsonHandler(t *testing.T) {
+func TestProxyHandlerRelaysResponse(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("POST /json", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
 		res.WriteHeader(http.StatusOK)
 		io.Copy(res, req.Body)
 	})
+	proxy := newStreamingProxy(t, Config{}, mux)
+	ins := G_LB.instances[0]
 
-	testServer := httptest.NewServer(mux)
-	defer testServer.Close()
-	ins, err := NewInstance(fmt.Sprintf("http://%s", testServer.Listener.Addr()))
+	resp, err := http.Post(proxy.URL+"/json", "application/json", bytes.NewBuffer([]byte{}))
 	if err != nil {
-		t.Fatal("error setting up test server: ", err)
+		t.Fatal("request through the proxy failed: ", err)
 	}
+	resp.Body.Close()
 
-	req, err := http.NewRequest(http.MethodPost, "/json", bytes.NewBuffer([]byte{}))
-	if err != nil {
-		t.Fatal("error creating new request: ", err)
+	if resp.StatusCode != http.StatusOK {
+		t.Error("should have received 200. Instead received: ", resp.StatusCode)
+	}
+
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Error("handler should be relaying `Content-Type: application/json` from the instance")
 	}
 
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		err := ins.jsonHandler(res, req)
-		if err != nil {
-			res.WriteHeader(http.StatusServiceUnavailable)
+	time.Sleep(time.Second * 2)
+
+	if ins.latencyPercentile(0.5) == 0 {
+		t.Error("ins.latency should have been filled by now")
+	}
+}
+
+func TestProxyHandlerPassthrough(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /items/{id}", func(res http.ResponseWriter, req *http.Request) {
+		if req.PathValue("id") != "42" || req.URL.RawQuery != "force=true&tag=a%20b" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Header.Get("X-Custom") != "custom" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
 		}
+		if req.Header.Get("Connection") != "" || req.Header.Get("Keep-Alive") != "" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		res.Header().Set("Trailer", "X-Checksum")
+		res.Header().Set("X-Upstream", "responder")
+		res.Header().Set("Content-Type", "text/plain")
+		res.WriteHeader(http.StatusAccepted)
+		res.Write(body)
+		res.Header().Set("X-Checksum", "abc")
 	})
-	handler.ServeHTTP(rr, req)
 
-	if rr.Code != http.StatusOK {
-		t.Error("should have received 200. Instead received: ", rr.Code)
+	proxy := newStreamingProxy(t, Config{}, mux)
+
+	req, err := http.NewRequest(http.MethodDelete, proxy.URL+"/items/42?force=true&tag=a%20b", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal("error creating new request: ", err)
 	}
+	req.Header.Set("X-Custom", "custom")
+	req.Header.Set("Keep-Alive", "timeout=5")
 
-	if rr.Header().Get("Content-Type") != "application/json" {
-		t.Error("handler should be setting `Content-Type: application/json` for 200 response")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("request through the proxy failed: ", err)
 	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
 
-	time.Sleep(time.Second * 2)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Status: Expected: `%d`, Actual: `%d`\n", http.StatusAccepted, resp.StatusCode)
+	}
+	if string(body) != "payload" {
+		t.Errorf("Body: Expected: `payload`, Actual: `%s`\n", body)
+	}
+	if resp.Header.Get("X-Upstream") != "responder" || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Error("response headers were not relayed: ", resp.Header)
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Error("response trailers were not relayed: ", resp.Trailer)
+	}
+}
 
-	if len(ins.responseTimeCache) != 1 {
-		t.Error("ins.responseTimeCache should have been filled by now")
+func TestProxyHandlerInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		res.WriteHeader(http.StatusOK)
+	}))
+	ins := G_LB.instances[0]
+
+	done := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+		http.HandlerFunc(proxyHandler).ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	<-started
+	if ins.inFlight.Load() != 1 {
+		t.Errorf("1 request should be in flight. Actual: %d\n", ins.inFlight.Load())
+	}
+	close(release)
+	<-done
+	if ins.inFlight.Load() != 0 {
+		t.Errorf("no request should be in flight. Actual: %d\n", ins.inFlight.Load())
 	}
 }
 
@@ -238,19 +360,16 @@ func TestLBRemoveInstance(t *testing.T) {
 	// Wait a little bit for context cancel function to get registered
 	time.Sleep(time.Second * 2)
 
-	instance.mx.Lock()
-	instance.responseTimeCache = []int64{5, 4, 3, 2, 1}
-	instance.mx.Unlock()
+	instance.latency.record(time.Now().Add(-time.Minute), time.Millisecond*5)
 
-	// Wait for anything above 2 seconds since average calculation happens
-	// every 2 seconds and if the duration since last response is greater
-	// than 10 - in this case it should be, since lastResponseAt is initialized to 0.
-	// But because moitoring should go off - data inside responseTimeCache
-	// should not change
+	// Wait for anything above 2 seconds since latency reporting happens
+	// every 2 seconds and would forget samples that are older than 5 seconds -
+	// as this one is. But because monitoring should go off - the sample
+	// should still be there
 	time.Sleep(time.Second * 6)
 
-	if len(instance.responseTimeCache) != 5 {
-		t.Errorf("instance monitoring did not stop. Actual: %d. Expected: %d\n", len(instance.responseTimeCache), 5)
+	if instance.latencyPercentile(0.5) == 0 {
+		t.Error("instance monitoring did not stop. Latency samples were forgotten")
 	}
 
 	if len(lb.instances) != 0 {
@@ -309,7 +428,7 @@ func TestLBGetInstance(t *testing.T) {
 	}
 
 	// Round robin should skip unavailable node
-	ins1.avgResponseTimeMilli = 101
+	ins1.latency.record(time.Now(), time.Millisecond*101)
 
 	rIns1 = lb.GetInstance()
 	rIns2 = lb.GetInstance()
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_LISTEN_ADDR = ":30000"
+const DEFAULT_TLS_MIN_VERSION = "1.2"
+const DEFAULT_TLS_RELOAD_INTERVAL = time.Second * 10
+
+// A certificate and key pair the listener serves, as files on disk
+type certPair struct {
+	certFile string
+	keyFile  string
+}
+
+// Certificates loaded from a set of pairs, indexed by the host names they
+// are valid for
+type certSet struct {
+	byName   map[string]*tls.Certificate // Exact names and `*.` wildcards
+	fallback *tls.Certificate            // Served when nothing matches. The first pair
+}
+
+// The certificates the listener terminates TLS with. They are picked by the
+// server name the client asks for (SNI) and reloaded when their files change
+// on disk. Reloads only affect new handshakes, established connections keep
+// going with the certificate they were set up with
+type certStore struct {
+	pairs []certPair
+	set   atomic.Pointer[certSet]
+
+	mx       sync.Mutex
+	modTimes map[string]time.Time // Of every cert and key file, as of the last load
+}
+
+// Parses `spec` - comma separated `cert:key` file pairs - and loads the
+// certificates. Eg: `/certs/a.pem:/certs/a-key.pem,/certs/b.pem:/certs/b-key.pem`
+func newCertStore(spec string) (*certStore, error) {
+	store := &certStore{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		certFile, keyFile, ok := strings.Cut(pair, ":")
+		if !ok || certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("[newCertStore] -> invalid certificate pair: `%s`. Expected `cert:key`", pair)
+		}
+		store.pairs = append(store.pairs, certPair{certFile: certFile, keyFile: keyFile})
+	}
+	if len(store.pairs) == 0 {
+		return nil, fmt.Errorf("[newCertStore] -> no certificate pairs in `%s`", spec)
+	}
+	if _, err := store.reload(); err != nil {
+		return nil, fmt.Errorf("[newCertStore] -> %s", err)
+	}
+	return store, nil
+}
+
+// Loads all pairs again if any of their files changed since the last load.
+// On error the certificates loaded before stay in use. Reports whether a new
+// set of certificates was loaded
+func (s *certStore) reload() (bool, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	modTimes := map[string]time.Time{}
+	changed := s.modTimes == nil
+	for _, pair := range s.pairs {
+		for _, file := range []string{pair.certFile, pair.keyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return false, fmt.Errorf("error reading `%s`: %s", file, err)
+			}
+			modTimes[file] = info.ModTime()
+			if !info.ModTime().Equal(s.modTimes[file]) {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	set := &certSet{byName: map[string]*tls.Certificate{}}
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("error loading `%s`: %s", pair.certFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return false, fmt.Errorf("error parsing `%s`: %s", pair.certFile, err)
+			}
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// Earlier pairs win when several are valid for a name
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = &cert
+			}
+		}
+		if set.fallback == nil {
+			set.fallback = &cert
+		}
+	}
+	s.set.Store(set)
+	s.modTimes = modTimes
+	return true, nil
+}
+
+// Picks the certificate for the server name in `hello`. An exact match is
+// preferred over a wildcard one, and clients that send no server name or one
+// no certificate is valid for get the first pair
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.set.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := set.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := set.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return set.fallback, nil
+}
+
+// Checks the certificate files for changes every `interval` until `ctx` is done
+func (s *certStore) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := s.reload()
+			if err != nil {
+				log.Println("[certStore.watch] -> keeping the current certificates: ", err)
+			} else if reloaded {
+				log.Println("[certStore.watch] -> reloaded certificates")
+			}
+		}
+	}
+}
+
+// Builds the server the LB listens with. It terminates TLS when certificates
+// are configured, watching them for changes until `ctx` is done. Clients
+// speak HTTP/1.1 or HTTP/2 to it - negotiated over TLS, or with prior
+// knowledge (h2c) on a plain listener when `cfg.H2C` is set
+func newServer(ctx context.Context, cfg Config, handler http.Handler) (*http.Server, error) {
+	server := &http.Server{Addr: cfg.ListenAddr, Handler: handler, Protocols: &http.Protocols{}}
+	server.Protocols.SetHTTP1(true)
+	if cfg.TLSCerts == "" {
+		if cfg.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("[newServer] -> client certificates can only be verified with `LB_TLS_CERTS` set")
+		}
+		server.Protocols.SetUnencryptedHTTP2(cfg.H2C)
+		return server, nil
+	}
+	server.Protocols.SetHTTP2(true)
+	certs, err := newCertStore(cfg.TLSCerts)
+	if err != nil {
+		return nil, fmt.Errorf("[newServer] -> %s", err)
+	}
+	server.TLSConfig, err = newListenerTLSConfig(cfg, certs)
+	if err != nil {
+		return nil, fmt.Errorf("[newServer] -> %s", err)
+	}
+	if err := withClientAuth(server.TLSConfig, cfg); err != nil {
+		return nil, fmt.Errorf("[newServer] -> %s", err)
+	}
+	go certs.watch(ctx, cfg.TLSReloadInterval)
+	return server, nil
+}
+
+// Builds the TLS configuration of the listener
+func newListenerTLSConfig(cfg Config, certs *certStore) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(cfg.TLSMinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("[newListenerTLSConfig] -> %s", err)
+	}
+	cipherSuites, err := parseCipherSuites(cfg.TLSCipherSuites)
+	if err != nil {
+		return nil, fmt.Errorf("[newListenerTLSConfig] -> %s", err)
+	}
+	return &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: certs.getCertificate,
+	}, nil
+}
+
+// Makes the listener ask clients for certificates and verify them against
+// the CAs in `cfg.TLSClientCAFile`. Clients without a valid one are rejected
+// in the handshake, or - with the `optional` mode - only those that send an
+// invalid one
+func withClientAuth(tlsConfig *tls.Config, cfg Config) error {
+	if cfg.TLSClientCAFile == "" {
+		return nil
+	}
+	bs, err := os.ReadFile(cfg.TLSClientCAFile)
+	if err != nil {
+		return fmt.Errorf("error reading client CA file: %s", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(bs) {
+		return fmt.Errorf("no PEM certificates in client CA file: `%s`", cfg.TLSClientCAFile)
+	}
+	switch cfg.TLSClientAuth {
+	case REQUIRE_CLIENT_AUTH:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case OPTIONAL_CLIENT_AUTH:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("unknown client auth mode: `%s`. Expected `require` or `optional`", cfg.TLSClientAuth)
+	}
+	return nil
+}
+
+func parseTLSVersion(value string) (uint16, error) {
+	switch value {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version: `%s`. Expected `1.0`, `1.1`, `1.2` or `1.3`", value)
+}
+
+// Parses comma separated cipher suite names as listed by tls.CipherSuites.
+// Empty leaves the choice to Go. Suites Go considers insecure are rejected
+func parseCipherSuites(value string) ([]uint16, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: `%s`", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a certificate for `commonName` and `dnsNames` issued by `ca` and
+// returns the `cert:key` pair of its files
+func writeTestCertPair(t *testing.T, ca *testCA, commonName string, dnsNames ...string) string {
+	t.Helper()
+	_, certPEM, keyPEM := ca.issue(t, commonName, dnsNames...)
+	return writeTestFile(t, "cert.pem", certPEM) + ":" + writeTestFile(t, "key.pem", keyPEM)
+}
+
+// Starts `server` on a random local port and returns its address
+func serveTLS(t *testing.T, server *http.Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	ca := newTestCA(t)
+	spec := strings.Join([]string{
+		writeTestCertPair(t, ca, "default", "default.example.com"),
+		writeTestCertPair(t, ca, "a", "a.example.com"),
+		writeTestCertPair(t, ca, "wildcard", "*.b.example.com"),
+		writeTestCertPair(t, ca, "exact", "x.b.example.com"),
+	}, ",")
+	store, err := newCertStore(spec)
+	if err != nil {
+		t.Fatal("newCertStore should not error here: ", err)
+	}
+
+	cases := map[string]string{
+		"a.example.com":   "a",
+		"A.Example.com.":  "a",
+		"y.b.example.com": "wildcard",
+		"x.b.example.com": "exact",
+		"b.example.com":   "default",
+		"unknown.com":     "default",
+		"":                "default",
+	}
+	for serverName, expected := range cases {
+		cert, _ := store.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if actual := cert.Leaf.Subject.CommonName; actual != expected {
+			t.Errorf("`%s` - Expected: `%s`. Actual: `%s`\n", serverName, expected, actual)
+		}
+	}
+}
+
+func TestNewCertStoreErrors(t *testing.T) {
+	ca := newTestCA(t)
+	pair := writeTestCertPair(t, ca, "a", "a.example.com")
+	certFile, _, _ := strings.Cut(pair, ":")
+	cases := []string{
+		"",
+		"cert.pem",
+		"/does/not/exist.pem:/does/not/exist-key.pem",
+		certFile + ":" + certFile,
+	}
+	for _, spec := range cases {
+		if _, err := newCertStore(spec); err == nil {
+			t.Errorf("`%s` should be rejected\n", spec)
+		}
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	server, err := newServer(t.Context(), Config{
+		TLSCerts:      writeTestCertPair(t, ca, "lb", "lb.example.com"),
+		TLSMinVersion: "1.3",
+	}.withDefaults(), http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.Proto))
+	}))
+	if err != nil {
+		t.Fatal("newServer should not error here: ", err)
+	}
+	addr := serveTLS(t, server)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    ca.pool(),
+		ServerName: "lb.example.com",
+	}}}
+	resp, err := client.Get("https://" + addr)
+	if err != nil {
+		t.Fatal("request over TLS should succeed: ", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3. Actual: %x\n", resp.TLS.Version)
+	}
+
+	// Below the minimum version
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    ca.pool(),
+		ServerName: "lb.example.com",
+		MaxVersion: tls.VersionTLS12,
+	}}}
+	if _, err := client.Get("https://" + addr); err == nil {
+		t.Error("TLS 1.2 should be rejected when the minimum is 1.3")
+	}
+
+	// Without certificates the server speaks plain HTTP
+	server, err = newServer(t.Context(), Config{}.withDefaults(), http.NotFoundHandler())
+	if err != nil || server.TLSConfig != nil {
+		t.Error("server without certificates should not use TLS: ", err)
+	}
+	if server.Addr != DEFAULT_LISTEN_ADDR {
+		t.Errorf("Expected: `%s`. Actual: `%s`\n", DEFAULT_LISTEN_ADDR, server.Addr)
+	}
+}
+
+func TestServerTLSPolicyErrors(t *testing.T) {
+	ca := newTestCA(t)
+	certs := writeTestCertPair(t, ca, "lb", "lb.example.com")
+	cases := []Config{
+		{TLSCerts: certs, TLSMinVersion: "1.4"},
+		{TLSCerts: certs, TLSCipherSuites: "TLS_NOT_A_SUITE"},
+		{TLSCerts: certs, TLSCipherSuites: "TLS_RSA_WITH_RC4_128_SHA"},
+	}
+	for _, cfg := range cases {
+		if _, err := newServer(t.Context(), cfg.withDefaults(), http.NotFoundHandler()); err == nil {
+			t.Errorf("config should be rejected: %+v\n", cfg)
+		}
+	}
+
+	suites, err := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	if err != nil || len(suites) != 2 || suites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Error("cipher suites should be parsed in order: ", suites, err)
+	}
+}
+
+func TestServerCertificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	pair := writeTestCertPair(t, ca, "old", "lb.example.com")
+	certFile, keyFile, _ := strings.Cut(pair, ":")
+
+	server, err := newServer(t.Context(), Config{
+		TLSCerts:          pair,
+		TLSReloadInterval: time.Millisecond * 10,
+	}.withDefaults(), http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.TLS.ServerName))
+	}))
+	if err != nil {
+		t.Fatal("newServer should not error here: ", err)
+	}
+	addr := serveTLS(t, server)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    ca.pool(),
+		ServerName: "lb.example.com",
+	}}}
+	get := func() (string, bool) {
+		reused := false
+		req, _ := http.NewRequest(http.MethodGet, "https://"+addr, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal("request over TLS should succeed: ", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, reused
+	}
+	if name, _ := get(); name != "old" {
+		t.Fatalf("Expected: `old`. Actual: `%s`\n", name)
+	}
+
+	// A broken certificate is not picked up
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	time.Sleep(time.Millisecond * 50)
+	if name, reused := get(); name != "old" || !reused {
+		t.Errorf("broken certificate should be ignored. Actual: `%s`\n", name)
+	}
+
+	_, certPEM, keyPEM := ca.issue(t, "new", "lb.example.com")
+	os.WriteFile(certFile, certPEM, 0600)
+	os.WriteFile(keyFile, keyPEM, 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	time.Sleep(time.Millisecond * 50)
+
+	// The established connection keeps going with the old certificate
+	if name, reused := get(); name != "old" || !reused {
+		t.Errorf("established connection should be kept. Certificate: `%s`, reused: %v\n", name, reused)
+	}
+
+	// New connections get the new one
+	client.CloseIdleConnections()
+	if name, reused := get(); name != "new" || reused {
+		t.Errorf("new connection should get the reloaded certificate. Certificate: `%s`, reused: %v\n", name, reused)
+	}
+}
+
+func TestServerProtocols(t *testing.T) {
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.Proto))
+	})
+	get := func(client *http.Client, url string) string {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal("request should succeed: ", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// HTTP/2 is negotiated over TLS
+	ca := newTestCA(t)
+	server, _ := newServer(t.Context(), Config{TLSCerts: writeTestCertPair(t, ca, "lb", "lb.example.com")}.withDefaults(), handler)
+	addr := serveTLS(t, server)
+	tlsConfig := &tls.Config{RootCAs: ca.pool(), ServerName: "lb.example.com"}
+	h2 := &http.Transport{TLSClientConfig: tlsConfig.Clone(), Protocols: &http.Protocols{}}
+	h2.Protocols.SetHTTP2(true)
+	if proto := get(&http.Client{Transport: h2}, "https://"+addr); proto != "HTTP/2.0" {
+		t.Errorf("Expected: `HTTP/2.0`. Actual: `%s`\n", proto)
+	}
+	if proto := get(&http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig.Clone()}}, "https://"+addr); proto != "HTTP/1.1" {
+		t.Errorf("Expected: `HTTP/1.1`. Actual: `%s`\n", proto)
+	}
+
+	// h2c on the plain listener only when enabled
+	h2c := &http.Transport{Protocols: &http.Protocols{}}
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	for _, enabled := range []bool{true, false} {
+		server, _ := newServer(t.Context(), Config{H2C: enabled}.withDefaults(), handler)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(ln)
+		defer server.Close()
+
+		resp, err := (&http.Client{Transport: h2c}).Get("http://" + ln.Addr().String())
+		if enabled && (err != nil || resp.Proto != "HTTP/2.0") {
+			t.Error("h2c should be accepted when enabled: ", err)
+		}
+		if !enabled && err == nil {
+			t.Error("h2c should be rejected when disabled")
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if proto := get(http.DefaultClient, "http://"+ln.Addr().String()); proto != "HTTP/1.1" {
+			t.Errorf("HTTP/1.1 should always be accepted. Actual: `%s`\n", proto)
+		}
+	}
+}
@@ -3,11 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -24,52 +23,216 @@ var G_LB *LB
 // Metrics
 var RESPONSE_DURATION_METRIC = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "avg_response_duration_millis",
-	Help: "Average response duration guage data in milliseconds",
+	Help: "Time decayed mean response duration in milliseconds",
 }, []string{"instance"})
 
+var RESPONSE_LATENCY_METRIC = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "response_latency_micros",
+	Help: "Response latency percentiles in microseconds",
+}, []string{"instance", "quantile"})
+
+// Latency percentiles reported in metrics and GET /status
+var LATENCY_QUANTILES = []float64{0.5, 0.9, 0.99}
+
+var UPSTREAM_CONNECTIONS_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "upstream_connections_total",
+	Help: "Connections requests to instances went out on by whether they were reused from the pool",
+}, []string{"instance", "reused"})
+
+var UPSTREAM_DIALS_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "upstream_dials_total",
+	Help: "New connections dialed to instances by result",
+}, []string{"result"})
+
+var REQUEST_PROTOCOL_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "requests_by_protocol_total",
+	Help: "Requests received from clients by HTTP version",
+}, []string{"protocol"})
+
+var UPSTREAM_PROTOCOL_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "upstream_requests_by_protocol_total",
+	Help: "Requests answered by instances by the HTTP version they were answered over",
+}, []string{"instance", "protocol"})
+
+var UPGRADED_CONNECTIONS_METRIC = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "upgraded_connections",
+	Help: "Connections that switched protocols, eg. WebSockets, currently open per instance",
+}, []string{"instance"})
+
+var GRPC_STATUS_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grpc_responses_total",
+	Help: "gRPC calls by the status they ended with",
+}, []string{"code"})
+
 var RESPONSE_STATUS_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "response_status",
 	Help: "Response status code",
 }, []string{"status"})
 
-func jsonHandler(res http.ResponseWriter, req *http.Request) {
-	instance := G_LB.GetInstance()
+var RETRY_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "retries_total",
+	Help: "Retried requests by what caused the retry",
+}, []string{"reason"})
+
+var RETRY_BUDGET_EXHAUSTED_METRIC = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "retry_budget_exhausted_total",
+	Help: "Retries skipped because the retry budget was exhausted",
+})
+
+var BREAKER_STATE_METRIC = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "circuit_breaker_state",
+	Help: "Circuit breaker state per instance. 0: closed, 1: half-open, 2: open",
+}, []string{"instance"})
+
+var BREAKER_TRANSITIONS_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "circuit_breaker_transitions_total",
+	Help: "Circuit breaker state changes per instance by the state changed to",
+}, []string{"instance", "state"})
+
+var OUTLIER_EJECTIONS_METRIC = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "outlier_ejections_total",
+	Help: "Instances ejected by outlier detection by the reason they were ejected for",
+}, []string{"instance", "reason"})
+
+// Proxies any request, that isn't meant for the LB itself, to an available instance
+func proxyHandler(res http.ResponseWriter, req *http.Request) {
+	REQUEST_PROTOCOL_METRIC.WithLabelValues(req.Proto).Inc()
+	if req.ContentLength > G_LB.cfg.BodyMaxSize {
+		logRequest(req, "[proxyHandler] -> %s\n", errBodyTooLarge)
+		writeError(res, req, http.StatusRequestEntityTooLarge, errBodyTooLarge.Error())
+		return
+	}
+	// The body streams to the instance as it arrives and is recorded on the way
+	// so that it can be sent again if the first attempt fails. Streams longer
+	// than the max size are passed on without being recorded
+	body := newReplayBody(req.Body, G_LB.cfg.BodyMemoryLimit, G_LB.cfg.BodyMaxSize, G_LB.cfg.BodyTempDir)
+	defer body.Close()
+	// Let the response stream back while the request body is still coming in
+	http.NewResponseController(res).EnableFullDuplex()
+	// gRPC clients say how long they are willing to wait. Retries have to fit
+	// in as well and instances are told what's left. See propagateGRPCDeadline
+	if timeout, ok := parseGRPCTimeout(req.Header.Get("Grpc-Timeout")); ok && isGRPC(req.Header) {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	G_LB.retryBudget.deposit(time.Now())
+	tried := []*Instance{}
+	// Retries never go to an instance that has already been tried
+	pick := func() *Instance {
+		// The hash balancer may read a JSON key from this one
+		req.Body = body.Reader()
+		return G_LB.GetInstanceFor(req, tried...)
+	}
+	instance := pick()
 	if instance == nil {
-		log.Println("[jsonHandler] -> No available instance")
-		RESPONSE_STATUS_METRIC.WithLabelValues(fmt.Sprintf("%d", http.StatusServiceUnavailable)).Inc()
-		res.WriteHeader(http.StatusServiceUnavailable)
+		logRequest(req, "[proxyHandler] -> No available instance\n")
+		writeError(res, req, http.StatusServiceUnavailable, "no available instance")
 		return
 	}
+	for attempt := 1; ; attempt++ {
+		tried = append(tried, instance)
+
+		// A fresh reader from the start, whatever picking the instance read -
+		// unless doing so took the body past what can be recorded
+		if body.Replayable() {
+			req.Body = body.Reader()
+		}
+		start := time.Now()
+		resp, err := instance.roundTrip(req)
+		status := 0
+		if resp != nil {
+			status = responseStatus(resp, false)
+		}
+		if err != nil {
+			logRequest(req, "[proxyHandler] -> %s\n", err)
+		}
+		// Failing to read the client's body is no fault of the instance
+		if bodyErr := body.Err(); bodyErr != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			G_LB.Abandon(instance)
+			logRequest(req, "[proxyHandler] -> %s\n", bodyErr)
+			writeError(res, req, http.StatusBadRequest, "error reading request body")
+			return
+		}
+		// The status of most gRPC calls is only known from the trailers, once
+		// the response has been relayed
+		observeLater := err == nil && isGRPC(resp.Header) && resp.Header.Get("Grpc-Status") == ""
+		if !observeLater {
+			G_LB.Observe(instance, status, time.Since(start), err)
+		}
 
-	if err := instance.jsonHandler(res, req); err != nil {
-		// Retry - in a second and a half need
-		// not be here and can be abstracted away if more than 1 retry is needed
-		time.Sleep(time.Millisecond * 1500)
-		instance := G_LB.GetInstance()
-		if instance == nil {
-			log.Println("[jsonHandler] -> No available instance")
-			RESPONSE_STATUS_METRIC.WithLabelValues(fmt.Sprintf("%d", http.StatusServiceUnavailable)).Inc()
-			res.WriteHeader(http.StatusServiceUnavailable)
+		reason := G_LB.retryPolicy.retryReason(resp, err)
+		// The response is only given up on once it's certain that it will be
+		// retried. Otherwise it's relayed as is
+		if reason != "" && attempt < G_LB.retryPolicy.maxAttempts && req.Context().Err() == nil {
+			if !body.Replayable() {
+				logRequest(req, "[proxyHandler] -> body too large to be sent again\n")
+			} else if next := pick(); next == nil {
+				logRequest(req, "[proxyHandler] -> no instance left to retry on\n")
+			} else if !G_LB.retryBudget.withdraw(time.Now()) {
+				G_LB.Abandon(next)
+				logRequest(req, "[proxyHandler] -> retry budget exhausted\n")
+				RETRY_BUDGET_EXHAUSTED_METRIC.Inc()
+			} else {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				RETRY_METRIC.WithLabelValues(reason).Inc()
+				backoff := G_LB.retryPolicy.backoff(attempt)
+				logRequest(req, "[proxyHandler] -> retrying %s %s after `%s` from `%s` in %s\n", req.Method, req.URL.Path, reason, instance.url, backoff)
+				select {
+				case <-time.After(backoff):
+					instance = next
+					continue
+				case <-req.Context().Done():
+					G_LB.Abandon(next)
+					if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+						writeError(res, req, http.StatusGatewayTimeout, "deadline exceeded")
+					}
+					// Otherwise the client went away. There is no one left to respond to
+					return
+				}
+			}
+		}
+
+		if err != nil {
+			if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+				writeError(res, req, http.StatusGatewayTimeout, "deadline exceeded")
+				return
+			}
+			writeError(res, req, http.StatusServiceUnavailable, "error calling instance")
 			return
 		}
-		if err := instance.jsonHandler(res, req); err != nil {
-			RESPONSE_STATUS_METRIC.WithLabelValues(fmt.Sprintf("%d", http.StatusServiceUnavailable)).Inc()
-			res.WriteHeader(http.StatusServiceUnavailable)
+		// Nothing will send the rest of the body again
+		body.stopRecording()
+		// The request ID in the response is the LB's
+		resp.Header.Del(G_LB.requestIDs.header)
+		instance.writeResponse(res, req, resp)
+		if code, ok := grpcStatus(resp); ok && isGRPC(resp.Header) {
+			GRPC_STATUS_METRIC.WithLabelValues(code.String()).Inc()
+		}
+		if observeLater {
+			G_LB.Observe(instance, responseStatus(resp, true), time.Since(start), req.Context().Err())
 		}
+		return
 	}
 }
 
 func addInstanceHandler(res http.ResponseWriter, req *http.Request) {
 	instanceUrl, err := io.ReadAll(req.Body)
 	if err != nil {
-		log.Println("[addInstanceHandler] -> error reading request body", err)
-		res.WriteHeader(http.StatusBadRequest)
+		logRequest(req, "[addInstanceHandler] -> error reading request body: %s\n", err)
+		writeError(res, req, http.StatusBadRequest, "error reading request body")
 		return
 	}
 
 	if err := G_LB.AddInstance(string(instanceUrl)); err != nil {
-		log.Println("[addInstanceHandler] -> ", err.Error())
-		res.WriteHeader(http.StatusBadRequest)
+		logRequest(req, "[addInstanceHandler] -> %s\n", err)
+		writeError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
 	res.WriteHeader(http.StatusOK)
@@ -78,8 +241,8 @@ func addInstanceHandler(res http.ResponseWriter, req *http.Request) {
 func removeInstanceHandler(res http.ResponseWriter, req *http.Request) {
 	instanceUrl, err := io.ReadAll(req.Body)
 	if err != nil {
-		log.Println("[removeInstanceHandler] -> error reading request body", err)
-		res.WriteHeader(http.StatusBadRequest)
+		logRequest(req, "[removeInstanceHandler] -> error reading request body: %s\n", err)
+		writeError(res, req, http.StatusBadRequest, "error reading request body")
 		return
 	}
 
@@ -87,12 +250,49 @@ func removeInstanceHandler(res http.ResponseWriter, req *http.Request) {
 	res.WriteHeader(http.StatusOK)
 }
 
+type instanceStatus struct {
+	URL             string        `json:"url"`
+	Weight          int           `json:"weight"`
+	EffectiveWeight float64       `json:"effectiveWeight"` // Weight with slow start taken into account
+	InFlight        int64         `json:"inFlight"`
+	Upgraded        int           `json:"upgraded"` // Open connections that switched protocols
+	Breaker         string        `json:"breaker"`
+	Ejected         bool          `json:"ejected"`
+	Latency         latencyStatus `json:"latencyMicros"`
+}
+
+// Latency percentiles in microseconds
+type latencyStatus struct {
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+}
+
 func nodeStatusHandler(res http.ResponseWriter, req *http.Request) {
 	healthy := []string{}
 	available := []string{}
 	all := []string{}
+	instances := []instanceStatus{}
 	for _, v := range G_LB.instances {
 		all = append(all, v.url)
+		breaker := breakerClosed
+		if v.breaker != nil {
+			breaker = v.breaker.State(time.Now())
+		}
+		instances = append(instances, instanceStatus{
+			URL:             v.url,
+			Weight:          v.weight,
+			EffectiveWeight: v.effectiveWeight(time.Now()),
+			InFlight:        v.inFlight.Load(),
+			Upgraded:        v.upgrades.count(),
+			Breaker:         breaker.String(),
+			Ejected:         v.isEjected(time.Now()),
+			Latency: latencyStatus{
+				P50: v.latencyPercentile(0.5).Microseconds(),
+				P90: v.latencyPercentile(0.9).Microseconds(),
+				P99: v.latencyPercentile(0.99).Microseconds(),
+			},
+		})
 
 		if v.healthy {
 			healthy = append(healthy, v.url)
@@ -103,18 +303,20 @@ func nodeStatusHandler(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 	resp := struct {
-		Healthy   []string `json:"healthy"`
-		Available []string `json:"available"`
-		All       []string `json:"all"`
+		Healthy   []string         `json:"healthy"`
+		Available []string         `json:"available"`
+		All       []string         `json:"all"`
+		Instances []instanceStatus `json:"instances"`
 	}{
 		Healthy:   healthy,
 		Available: available,
 		All:       all,
+		Instances: instances,
 	}
 	bs, err := json.Marshal(resp)
 	if err != nil {
-		log.Println("[healthyNodes] -> error marshalling json: ", err)
-		res.WriteHeader(http.StatusInternalServerError)
+		logRequest(req, "[healthyNodes] -> error marshalling json: %s\n", err)
+		writeError(res, req, http.StatusInternalServerError, "error marshalling json")
 		return
 	}
 	res.Header().Set("Content-Type", "application/json")
@@ -123,11 +325,12 @@ func nodeStatusHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 func router(mux *http.ServeMux) {
-	mux.HandleFunc("POST /json", jsonHandler)
 	mux.HandleFunc("PUT /addinstance", addInstanceHandler)
 	mux.HandleFunc("PUT /removeinstance", removeInstanceHandler)
 	mux.HandleFunc("GET /status", nodeStatusHandler)
 	mux.Handle("/metrics", promhttp.Handler())
+	// Everything else is proxied to the instances
+	mux.HandleFunc("/", proxyHandler)
 }
 
 func main() {
@@ -139,8 +342,11 @@ func main() {
 	defer cancel()
 
 	// initialize global instance of Load Balancer
-	var err error
-	G_LB, err = NewLB(mainCtx, os.Getenv("LB_INSTANCELIST"))
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		log.Fatal("[main] -> ", err.Error())
+	}
+	G_LB, err = NewLBWithConfig(mainCtx, cfg)
 	if err != nil {
 		log.Fatal("[main] -> ", err.Error())
 	}
@@ -148,8 +354,19 @@ func main() {
 	mux := http.NewServeMux()
 	router(mux)
 
-	log.Println("Starting server at ':30000'")
-	if err := http.ListenAndServe(":30000", mux); err != nil {
+	cfg = cfg.withDefaults()
+	server, err := newServer(mainCtx, cfg, G_LB.requestIDs.handler(G_LB.identities.handler(mux)))
+	if err != nil {
+		log.Fatal("[main] -> ", err.Error())
+	}
+	if server.TLSConfig != nil {
+		log.Printf("Starting TLS server at '%s'\n", server.Addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Starting server at '%s'\n", server.Addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatal("[main] -> err starting server: ", err)
 	}
 }
@@ -2,9 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestAddInstanceHandlerSuccess(t *testing.T) {
@@ -32,6 +38,31 @@ func TestAddInstanceHandlerSuccess(t *testing.T) {
 	}
 }
 
+func TestAddInstanceHandlerWeight(t *testing.T) {
+	var err error
+	G_LB, err = NewLB(t.Context(), "")
+	if err != nil {
+		t.Fatal("NewLB should not error here: ", err.Error())
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(addInstanceHandler)
+
+	req, err := http.NewRequest(http.MethodPut, "http://localhost:30000/addinstance", bytes.NewBuffer([]byte(`http://localhost:20000;weight=4`)))
+	if err != nil {
+		t.Fatal("NewRequest should not error here: ", err.Error())
+	}
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Status: Expected: `%d`, Actual: `%d`\n", http.StatusOK, rr.Code)
+	}
+
+	if len(G_LB.instances) != 1 || G_LB.instances[0].weight != 4 {
+		t.Errorf("Instance did not get added with its weight")
+	}
+}
+
 func TestAddInstanceHandlerFailure(t *testing.T) {
 	var err error
 	G_LB, err = NewLB(t.Context(), "")
@@ -84,7 +115,7 @@ func TestRemoveInstanceHandler(t *testing.T) {
 
 func TestNodeStatusHandler(t *testing.T) {
 	var err error
-	G_LB, err = NewLB(t.Context(), "http://localhost:20000,http://localhost:20001")
+	G_LB, err = NewLB(t.Context(), "http://localhost:20000,http://localhost:20001;weight=3")
 	if err != nil {
 		t.Fatal("NewLB should not error here: ", err.Error())
 	}
@@ -102,8 +133,244 @@ func TestNodeStatusHandler(t *testing.T) {
 		t.Errorf("Status: Expected: `%d`, Actual: `%d`\n", http.StatusOK, rr.Code)
 	}
 
-	expected := `{"healthy":[],"available":[],"all":["http://localhost:20000","http://localhost:20001"]}`
+	expected := `{"healthy":[],"available":[],"all":["http://localhost:20000","http://localhost:20001"],` +
+		`"instances":[{"url":"http://localhost:20000","weight":1,"effectiveWeight":1,"inFlight":0,"upgraded":0,"breaker":"closed","ejected":false,"latencyMicros":{"p50":0,"p90":0,"p99":0}},{"url":"http://localhost:20001","weight":3,"effectiveWeight":3,"inFlight":0,"upgraded":0,"breaker":"closed","ejected":false,"latencyMicros":{"p50":0,"p90":0,"p99":0}}]}`
 	if rr.Body.String() != expected {
 		t.Errorf("Status Body failed\nExpected: `%s`\nActual: `%s`\n", rr.Body.String(), expected)
 	}
 }
+
+func TestRouterProxiesUnknownRoutes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" {
+			res.WriteHeader(http.StatusOK)
+			return
+		}
+		res.Header().Set("Content-Type", "text/plain")
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte(req.Method + " " + req.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	newTestLB(t, Config{}, upstream.URL)
+
+	mux := http.NewServeMux()
+	router(mux)
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(method, "http://localhost:30000/some/path?q=1", nil)
+		if err != nil {
+			t.Fatal("NewRequest should not error here: ", err)
+		}
+		mux.ServeHTTP(rr, req)
+
+		body, _ := io.ReadAll(rr.Body)
+		expected := method + " /some/path?q=1"
+		if rr.Code != http.StatusOK || string(body) != expected {
+			t.Errorf("Expected: `200 %s`, Actual: `%d %s`\n", expected, rr.Code, body)
+		}
+	}
+}
+
+func TestProxyHandlerRetryResendsBody(t *testing.T) {
+	// Reads the whole body and then drops the connection without responding
+	failing := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		io.ReadAll(req.Body)
+		panic(http.ErrAbortHandler)
+	}))
+	defer failing.Close()
+
+	echo := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		res.WriteHeader(http.StatusOK)
+		res.Write(body)
+	}))
+	defer echo.Close()
+
+	for _, memLimit := range []int64{1 << 20, 1024} { // In memory and spilled to disk
+		// Round robin starts at the second instance
+		newTestLB(t, Config{BodyMemoryLimit: memLimit, BodyTempDir: t.TempDir()}, echo.URL, failing.URL)
+
+		payload := make([]byte, 64*1024)
+		rand.Read(payload)
+
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:30000/json", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal("NewRequest should not error here: ", err)
+		}
+		http.HandlerFunc(proxyHandler).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Status: Expected: `%d`, Actual: `%d`\n", http.StatusOK, rr.Code)
+		}
+		if !bytes.Equal(rr.Body.Bytes(), payload) {
+			t.Errorf("retried request did not carry the original payload. Sent %d bytes, received %d\n", len(payload), rr.Body.Len())
+		}
+	}
+}
+
+func TestProxyHandlerBodyTooLarge(t *testing.T) {
+	var err error
+	G_LB, err = NewLBWithConfig(t.Context(), Config{BodyMemoryLimit: 10, BodyMaxSize: 100, BodyTempDir: t.TempDir()})
+	if err != nil {
+		t.Fatal("NewLB should not error here: ", err)
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:30000/json", bytes.NewReader(make([]byte, 101)))
+	if err != nil {
+		t.Fatal("NewRequest should not error here: ", err)
+	}
+	http.HandlerFunc(proxyHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Status: Expected: `%d`, Actual: `%d`\n", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+}
+
+func TestProxyHandlerStreamsPastBodyMaxSize(t *testing.T) {
+	hits := 0
+	echo := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		hits += 1
+		body, _ := io.ReadAll(req.Body)
+		res.Write(body)
+	}))
+	defer echo.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		io.ReadAll(req.Body)
+		panic(http.ErrAbortHandler)
+	}))
+	defer failing.Close()
+
+	cfg := Config{BodyMemoryLimit: 10, BodyMaxSize: 1024, BodyTempDir: t.TempDir()}
+	newTestLB(t, cfg, echo.URL)
+	proxy := httptest.NewServer(http.HandlerFunc(proxyHandler))
+	defer proxy.Close()
+
+	// A stream of unknown length past the max size is passed on, not rejected
+	payload := make([]byte, 5000)
+	rand.Read(payload)
+	resp, err := http.Post(proxy.URL, "application/octet-stream", io.MultiReader(bytes.NewReader(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(received, payload) {
+		t.Errorf("stream past the max size should reach the instance. Status: %d, echoed %d bytes\n", resp.StatusCode, len(received))
+	}
+
+	// But it can't be retried
+	// Round robin starts at the second instance
+	newTestLB(t, cfg, echo.URL, failing.URL)
+	hits = 0
+	resp, err = http.Post(proxy.URL, "application/octet-stream", io.MultiReader(bytes.NewReader(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || hits != 0 {
+		t.Errorf("stream past the max size should not be retried. Status: %d, retries: %d\n", resp.StatusCode, hits)
+	}
+}
+
+func TestProxyHandlerRetriesConnectFailures(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+	// Nothing listens here anymore
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	// Round robin starts at the second instance
+	newTestLB(t, Config{RetryOn: "connect-failure", RetryMaxAttempts: 2, RetryBackoffBase: time.Millisecond}, ok.URL, closed.URL)
+	before := testutil.ToFloat64(RETRY_METRIC.WithLabelValues("connect-failure"))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(proxyHandler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+		t.Errorf("Expected: `200 ok`, Actual: `%d %s`\n", rr.Code, rr.Body.String())
+	}
+	if n := testutil.ToFloat64(RETRY_METRIC.WithLabelValues("connect-failure")) - before; n != 1 {
+		t.Errorf("refused connection should be retried as a connect failure. Retries: %v\n", n)
+	}
+}
+
+func TestProxyHandlerRetryPolicy(t *testing.T) {
+	hits := map[string]int{}
+	newUpstream := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			hits[name] += 1
+			res.WriteHeader(status)
+			res.Write([]byte(name))
+		}))
+	}
+	unavailable1 := newUpstream("unavailable1", http.StatusServiceUnavailable)
+	defer unavailable1.Close()
+	unavailable2 := newUpstream("unavailable2", http.StatusServiceUnavailable)
+	defer unavailable2.Close()
+	ok := newUpstream("ok", http.StatusOK)
+	defer ok.Close()
+
+	setup := func(cfg Config, urls ...string) {
+		cfg.RetryBackoffBase = time.Millisecond
+		newTestLB(t, cfg, urls...)
+		clear(hits)
+	}
+	serve := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:30000/", nil)
+		http.HandlerFunc(proxyHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// 503s are retried on other instances
+	setup(Config{RetryMaxAttempts: 3, RetryOn: "503"}, unavailable1.URL, unavailable2.URL, ok.URL)
+	rr := serve()
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+		t.Errorf("Expected: `200 ok`, Actual: `%d %s`\n", rr.Code, rr.Body.String())
+	}
+	if hits["unavailable1"] != 1 || hits["unavailable2"] != 1 || hits["ok"] != 1 {
+		t.Error("every instance should have been tried exactly once: ", hits)
+	}
+
+	// Attempts are capped and the last response is relayed
+	setup(Config{RetryMaxAttempts: 2, RetryOn: "503"}, unavailable1.URL, unavailable2.URL, ok.URL)
+	rr = serve()
+	if rr.Code != http.StatusServiceUnavailable || !strings.HasPrefix(rr.Body.String(), "unavailable") {
+		t.Errorf("Expected: `503 unavailable`, Actual: `%d %s`\n", rr.Code, rr.Body.String())
+	}
+	if hits["ok"] != 0 {
+		t.Error("no more than 2 attempts should have been made: ", hits)
+	}
+
+	// Never retried on the same instance
+	setup(Config{RetryMaxAttempts: 5, RetryOn: "503"}, unavailable1.URL)
+	rr = serve()
+	if rr.Code != http.StatusServiceUnavailable || hits["unavailable1"] != 1 {
+		t.Error("the only instance should have been tried once: ", hits)
+	}
+	if rr.Body.String() != "unavailable1" {
+		t.Errorf("response of the only instance should be relayed. Actual: `%s`\n", rr.Body.String())
+	}
+
+	// Statuses not in the policy are not retried
+	setup(Config{RetryMaxAttempts: 3, RetryOn: "error"}, ok.URL, unavailable1.URL)
+	rr = serve()
+	if rr.Code != http.StatusServiceUnavailable || hits["ok"] != 0 {
+		t.Error("503 should not have been retried: ", hits)
+	}
+
+	// No retries once the budget is spent
+	setup(Config{RetryMaxAttempts: 3, RetryOn: "503", RetryBudgetRatio: 0.0001, RetryBudgetMinPerSecond: 0.1}, ok.URL, unavailable1.URL)
+	rr = serve()
+	if rr.Code != http.StatusOK {
+		t.Error("first retry should fit in the budget")
+	}
+	rr = serve()
+	if rr.Code != http.StatusServiceUnavailable || rr.Body.String() != "unavailable1" || hits["ok"] != 1 {
+		t.Error("second retry should have been denied by the budget: ", hits)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Outlier counters of a single instance
+type outlierStats struct {
+	consecutive5xx int
+	requests       int // Since the last interval
+	successes      int // Since the last interval
+	ejections      int // Multiplies the ejection duration. Decays while the instance behaves
+}
+
+// Passive outlier detection - the same idea as Envoy's.
+// Instances are ejected from the pool, based on proxied traffic, when they
+// either:
+//   - fail `consecutive5xx` requests in a row
+//   - have a success rate, over the last interval, more than `stdevFactor`
+//     standard deviations below the mean of their peers
+//
+// An ejection lasts `baseEjection` x the number of times the instance has been
+// ejected, and no more than `maxEjectionPercent` of the pool is ever ejected at
+// the same time
+type outlierDetector struct {
+	mx                       sync.Mutex
+	consecutive5xx           int
+	interval                 time.Duration
+	baseEjection             time.Duration
+	maxEjectionPercent       int
+	successRateMinHosts      int
+	successRateRequestVolume int
+	successRateStdevFactor   float64
+	stats                    map[*Instance]*outlierStats
+}
+
+func newOutlierDetector(cfg Config) *outlierDetector {
+	return &outlierDetector{
+		consecutive5xx:           cfg.OutlierConsecutive5xx,
+		interval:                 cfg.OutlierInterval,
+		baseEjection:             cfg.OutlierBaseEjection,
+		maxEjectionPercent:       cfg.OutlierMaxEjectionPercent,
+		successRateMinHosts:      cfg.OutlierSuccessRateMinHosts,
+		successRateRequestVolume: cfg.OutlierSuccessRateRequestVolume,
+		successRateStdevFactor:   cfg.OutlierSuccessRateStdevFactor,
+		stats:                    map[*Instance]*outlierStats{},
+	}
+}
+
+// Must be called with od.mx held
+func (od *outlierDetector) statsOf(ins *Instance) *outlierStats {
+	stats, ok := od.stats[ins]
+	if !ok {
+		stats = &outlierStats{}
+		od.stats[ins] = stats
+	}
+	return stats
+}
+
+// Ejects `ins` unless that would take the pool over its ejection limit.
+// Must be called with od.mx held
+func (od *outlierDetector) eject(ins *Instance, instances []*Instance, now time.Time, reason string) bool {
+	if ins.isEjected(now) {
+		return false
+	}
+	ejected := 0
+	for _, i := range instances {
+		if i.isEjected(now) {
+			ejected += 1
+		}
+	}
+	// At least one instance may be ejected out of a pool of 2 or more, but never
+	// the whole pool
+	allowed := len(instances) * od.maxEjectionPercent / 100
+	if allowed < 1 && len(instances) > 1 {
+		allowed = 1
+	}
+	if ejected+1 > allowed || ejected+1 >= len(instances) {
+		return false
+	}
+
+	stats := od.statsOf(ins)
+	stats.ejections += 1
+	duration := od.baseEjection * time.Duration(stats.ejections)
+	ins.ejectedUntil.Store(now.Add(duration).UnixNano())
+	log.Printf("[outlierDetector.eject] -> ejected `%s` for %s: %s\n", ins.url, duration, reason)
+	OUTLIER_EJECTIONS_METRIC.WithLabelValues(ins.url, reason).Inc()
+	return true
+}
+
+// Records the outcome of a request proxied to `ins`. `instances` is the whole pool
+func (od *outlierDetector) observe(ins *Instance, instances []*Instance, now time.Time, success bool) {
+	od.mx.Lock()
+	defer od.mx.Unlock()
+
+	stats := od.statsOf(ins)
+	stats.requests += 1
+	if success {
+		stats.successes += 1
+		stats.consecutive5xx = 0
+		return
+	}
+	stats.consecutive5xx += 1
+	if stats.consecutive5xx >= od.consecutive5xx {
+		if od.eject(ins, instances, now, "consecutive-5xx") {
+			stats.consecutive5xx = 0
+		}
+	}
+}
+
+// Runs the success rate analysis over the traffic since the last call, resets
+// the counters and lets the ejection multiplier of well behaved instances decay
+func (od *outlierDetector) evaluate(instances []*Instance, now time.Time) {
+	od.mx.Lock()
+	defer od.mx.Unlock()
+
+	rates := map[*Instance]float64{}
+	sum := 0.0
+	for _, ins := range instances {
+		stats := od.statsOf(ins)
+		if stats.requests >= od.successRateRequestVolume {
+			rates[ins] = float64(stats.successes) / float64(stats.requests)
+			sum += rates[ins]
+		}
+	}
+
+	if len(rates) >= od.successRateMinHosts && len(rates) > 0 {
+		mean := sum / float64(len(rates))
+		variance := 0.0
+		for _, rate := range rates {
+			variance += (rate - mean) * (rate - mean)
+		}
+		stdev := math.Sqrt(variance / float64(len(rates)))
+		threshold := mean - od.successRateStdevFactor*stdev
+		for _, ins := range instances {
+			if rate, ok := rates[ins]; ok && rate < threshold {
+				od.eject(ins, instances, now, "success-rate")
+			}
+		}
+	}
+
+	for ins, stats := range od.stats {
+		if !slices.Contains(instances, ins) {
+			delete(od.stats, ins)
+			continue
+		}
+		stats.requests = 0
+		stats.successes = 0
+		if !ins.isEjected(now) && stats.ejections > 0 && stats.consecutive5xx == 0 {
+			stats.ejections -= 1
+		}
+	}
+}
+
+// Evaluates the pool every interval until `ctx` is done
+func (od *outlierDetector) run(ctx context.Context, instances func() []*Instance) {
+	tc := time.NewTicker(od.interval)
+	defer tc.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tc.C:
+			od.evaluate(instances(), now)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestOutlierDetector() *outlierDetector {
+	return newOutlierDetector(Config{
+		OutlierConsecutive5xx:           3,
+		OutlierInterval:                 time.Second * 10,
+		OutlierBaseEjection:             time.Second * 30,
+		OutlierMaxEjectionPercent:       50,
+		OutlierSuccessRateMinHosts:      3,
+		OutlierSuccessRateRequestVolume: 10,
+		OutlierSuccessRateStdevFactor:   1,
+	})
+}
+
+func testInstances(n int) []*Instance {
+	instances := []*Instance{}
+	for i := range n {
+		instances = append(instances, &Instance{url: string(rune('a' + i)), weight: 1, healthy: true})
+	}
+	return instances
+}
+
+func TestOutlierConsecutive5xx(t *testing.T) {
+	od := newTestOutlierDetector()
+	instances := testInstances(4)
+	a := instances[0]
+	now := time.Unix(1000, 0)
+
+	od.observe(a, instances, now, false)
+	od.observe(a, instances, now, false)
+	od.observe(a, instances, now, true) // Success resets the count
+	od.observe(a, instances, now, false)
+	od.observe(a, instances, now, false)
+	if a.isEjected(now) {
+		t.Fatal("instance should not be ejected yet")
+	}
+	od.observe(a, instances, now, false)
+	if !a.isEjected(now) {
+		t.Fatal("3 failures in a row should eject the instance")
+	}
+	if !a.isEjected(now.Add(time.Second*29)) || a.isEjected(now.Add(time.Second*30)) {
+		t.Error("first ejection should last the base ejection duration")
+	}
+
+	// Ejections get longer the more often an instance is ejected
+	now = now.Add(time.Second * 30)
+	for range 3 {
+		od.observe(a, instances, now, false)
+	}
+	if !a.isEjected(now.Add(time.Second*59)) || a.isEjected(now.Add(time.Second*60)) {
+		t.Error("second ejection should last twice the base ejection duration")
+	}
+
+	// and shorter again as the instance behaves
+	now = now.Add(time.Second * 60)
+	od.evaluate(instances, now)
+	od.evaluate(instances, now)
+	for range 3 {
+		od.observe(a, instances, now, false)
+	}
+	if !a.isEjected(now.Add(time.Second*29)) || a.isEjected(now.Add(time.Second*30)) {
+		t.Error("ejection multiplier should decay while the instance isn't ejected")
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	od := newTestOutlierDetector()
+	instances := testInstances(4)
+	now := time.Unix(1000, 0)
+
+	for _, ins := range instances {
+		for range 3 {
+			od.observe(ins, instances, now, false)
+		}
+	}
+	ejected := 0
+	for _, ins := range instances {
+		if ins.isEjected(now) {
+			ejected += 1
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("only 50%% of 4 instances should be ejected. Actual: %d\n", ejected)
+	}
+
+	// The last instance standing is never ejected
+	od = newTestOutlierDetector()
+	od.maxEjectionPercent = 100
+	instances = testInstances(2)
+	for _, ins := range instances {
+		for range 3 {
+			od.observe(ins, instances, now, false)
+		}
+	}
+	if instances[0].isEjected(now) == instances[1].isEjected(now) {
+		t.Error("exactly one of 2 instances should be ejected even at 100%")
+	}
+
+	instances = testInstances(1)
+	for range 3 {
+		od.observe(instances[0], instances, now, false)
+	}
+	if instances[0].isEjected(now) {
+		t.Error("the only instance should never be ejected")
+	}
+}
+
+func TestOutlierSuccessRate(t *testing.T) {
+	od := newTestOutlierDetector()
+	instances := testInstances(4)
+	now := time.Unix(1000, 0)
+
+	// a fails 1 in 2, everyone else is fine. Nobody fails 3 in a row
+	for i := range 20 {
+		for j, ins := range instances {
+			od.observe(ins, instances, now, j != 0 || i%2 == 0)
+		}
+	}
+	od.evaluate(instances, now)
+	if !instances[0].isEjected(now) {
+		t.Error("instance with a success rate far below its peers should be ejected")
+	}
+	for _, ins := range instances[1:] {
+		if ins.isEjected(now) {
+			t.Errorf("`%s` should not be ejected\n", ins.url)
+		}
+	}
+
+	// Not enough instances with enough traffic to compare
+	od = newTestOutlierDetector()
+	instances = testInstances(4)
+	for i := range 20 {
+		for j, ins := range instances[:2] {
+			od.observe(ins, instances, now, j != 0 || i%2 == 0)
+		}
+	}
+	od.evaluate(instances, now)
+	if instances[0].isEjected(now) {
+		t.Error("success rate should not be analysed with fewer than the minimum hosts")
+	}
+}
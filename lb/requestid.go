@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const DEFAULT_REQUEST_ID_HEADER = "X-Request-ID"
+
+// Formats generated request IDs can take
+const UUIDV7_REQUEST_ID = "uuidv7"
+const UUIDV4_REQUEST_ID = "uuidv4"
+
+// Incoming request IDs longer than this are replaced
+const REQUEST_ID_MAX_LENGTH = 128
+
+type requestIDKey struct{}
+
+// Gives every request an ID that ties together the log lines of the LB and of
+// the instance that served it. IDs sent by the client are kept, others are
+// generated
+type requestIDs struct {
+	header   string
+	generate func() string
+}
+
+func newRequestIDs(cfg Config) (*requestIDs, error) {
+	ids := &requestIDs{header: cfg.RequestIDHeader}
+	if ids.header == "" {
+		ids.header = DEFAULT_REQUEST_ID_HEADER
+	}
+	switch cfg.RequestIDFormat {
+	case UUIDV7_REQUEST_ID, "":
+		ids.generate = newUUIDv7
+	case UUIDV4_REQUEST_ID:
+		ids.generate = newUUIDv4
+	default:
+		return nil, fmt.Errorf("[newRequestIDs] -> unknown request ID format: `%s`. Expected `uuidv7` or `uuidv4`", cfg.RequestIDFormat)
+	}
+	return ids, nil
+}
+
+// Makes sure every request through `next` has an ID. The ID is set on the
+// request - and so forwarded to the instance - echoed in the response and
+// kept in the request's context for logging
+func (ids *requestIDs) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(ids.header)
+		if !validRequestID(id) {
+			id = ids.generate()
+		}
+		req.Header.Set(ids.header, id)
+		res.Header().Set(ids.header, id)
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Sets the ID of `req` on `out`, the request to the instance
+func (ids *requestIDs) apply(out http.Header, req *http.Request) {
+	if ids == nil {
+		return
+	}
+	if id := requestID(req); id != "" {
+		out.Set(ids.header, id)
+	}
+}
+
+// Printable ASCII without spaces, so that IDs can't mess up log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > REQUEST_ID_MAX_LENGTH {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// ID of the request. Empty for requests that didn't go through requestIDs.handler
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Logs a line about `req`, tagged with its ID
+func logRequest(req *http.Request, format string, args ...any) {
+	if id := requestID(req); id != "" {
+		format = "request_id=" + id + " " + format
+	}
+	log.Printf(format, args...)
+}
+
+// Responds with `status` and a JSON error body carrying the request ID, so that
+// a client can point at the log lines of a failed request
+func writeError(res http.ResponseWriter, req *http.Request, status int, message string) {
+	RESPONSE_STATUS_METRIC.WithLabelValues(fmt.Sprintf("%d", status)).Inc()
+	if isGRPC(req.Header) {
+		writeGRPCError(res, req, status, message)
+		return
+	}
+	bs, _ := json.Marshal(struct {
+		Error     string `json:"error"`
+		RequestID string `json:"requestId,omitempty"`
+	}{
+		Error:     message,
+		RequestID: requestID(req),
+	})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(bs)
+}
+
+// Time ordered UUID (RFC 9562) - 48 bits of unix milliseconds followed by
+// random bits, so that IDs sort by when the request came in
+func newUUIDv7() string {
+	var b [16]byte
+	rand.Read(b[6:])
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixMilli())<<16|uint64(binary.BigEndian.Uint16(b[6:8])))
+	b[6] = 0x70 | b[6]&0x0f
+	b[8] = 0x80 | b[8]&0x3f
+	return formatUUID(b)
+}
+
+// Random UUID (RFC 9562)
+func newUUIDv4() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = 0x40 | b[6]&0x0f
+	b[8] = 0x80 | b[8]&0x3f
+	return formatUUID(b)
+}
+
+func formatUUID(b [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
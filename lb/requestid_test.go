@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-([0-9a-f])[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewUUIDv7(t *testing.T) {
+	first := newUUIDv7()
+	time.Sleep(time.Millisecond * 2)
+	second := newUUIDv7()
+
+	for _, id := range []string{first, second} {
+		match := uuidPattern.FindStringSubmatch(id)
+		if match == nil || match[1] != "7" {
+			t.Errorf("`%s` is not a version 7 UUID", id)
+		}
+	}
+	if first >= second {
+		t.Errorf("UUIDv7s should sort by time. `%s` came before `%s`", first, second)
+	}
+	if match := uuidPattern.FindStringSubmatch(newUUIDv4()); match == nil || match[1] != "4" {
+		t.Error("newUUIDv4 should return a version 4 UUID")
+	}
+}
+
+func TestNewRequestIDs(t *testing.T) {
+	ids, err := newRequestIDs(Config{})
+	if err != nil || ids.header != DEFAULT_REQUEST_ID_HEADER {
+		t.Error("request IDs should default to `X-Request-ID`")
+	}
+	if _, err := newRequestIDs(Config{RequestIDFormat: "snowflake"}); err == nil {
+		t.Error("unknown format should be rejected")
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	ids, _ := newRequestIDs(Config{RequestIDHeader: "X-Trace"})
+	var seen string
+	handler := ids.handler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Trace") != requestID(req) {
+			t.Error("request ID should be set on the request for forwarding")
+		}
+		seen = requestID(req)
+	}))
+
+	cases := map[string]bool{ // Incoming ID: whether it is kept
+		"abc-123":                 true,
+		"":                        false,
+		"has space":               false,
+		string(make([]byte, 200)): false,
+	}
+	for incoming, kept := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if incoming != "" {
+			req.Header.Set("X-Trace", incoming)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if (seen == incoming) != kept || seen == "" {
+			t.Errorf("incoming `%.20s`: kept should be %v. Actual ID: `%s`", incoming, kept, seen)
+		}
+		if rr.Header().Get("X-Trace") != seen {
+			t.Error("request ID should be echoed in the response")
+		}
+	}
+}
+
+func TestProxyRequestID(t *testing.T) {
+	forwarded := make(chan string, 1)
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		forwarded <- req.Header.Get("X-Request-ID")
+		// Instances that echo the ID shouldn't duplicate it
+		res.Header().Set("X-Request-ID", req.Header.Get("X-Request-ID"))
+	}))
+	proxy.Config.Handler = G_LB.requestIDs.handler(http.HandlerFunc(proxyHandler))
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/", nil)
+	req.Header.Set("X-Request-ID", "client-id")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := <-forwarded; id != "client-id" {
+		t.Errorf("request ID should be forwarded to the instance. Actual: `%s`", id)
+	}
+	if ids := resp.Header.Values("X-Request-ID"); len(ids) != 1 || ids[0] != "client-id" {
+		t.Errorf("request ID should be echoed once. Actual: %v", ids)
+	}
+
+	// Errors carry the ID in their body
+	G_LB.RemoveInstance(G_LB.instances[0].url)
+	resp, err = http.Get(proxy.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Error     string `json:"error"`
+		RequestID string `json:"requestId"`
+	}
+	bs, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(bs, &body); err != nil {
+		t.Fatalf("error body should be JSON. Actual: `%s`", bs)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || body.RequestID == "" || body.RequestID != resp.Header.Get("X-Request-ID") {
+		t.Errorf("error body should carry the generated request ID. Actual: %d `%s`", resp.StatusCode, bs)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Decides whether and when a failed attempt is retried
+type retryPolicy struct {
+	maxAttempts      int
+	onError          bool // Any error reaching the instance
+	onConnectFailure bool // Only errors connecting to the instance
+	on5xx            bool
+	statuses         map[int]bool
+	grpcStatuses     map[codes.Code]bool
+	backoffBase      time.Duration
+	backoffMax       time.Duration
+}
+
+// Builds the retry policy from `cfg`. `cfg.RetryOn` is a comma separated list of:
+//   - error: the instance could not be reached or dropped the connection.
+//     Instances that took longer than UpstreamResponseHeaderTimeout to
+//     respond aren't retried, as they may still be working on the request
+//   - connect-failure: a connection to the instance could not be established.
+//     Unlike `error` the instance is known to not have seen the request
+//   - 5xx: any 5xx response
+//   - a status code. Eg: 503
+//   - a gRPC status, named as in GRPC_STATUS_NAMES. Eg: grpc-unavailable.
+//     Only calls that fail before sending a message - with the status in
+//     their headers - can be retried
+func newRetryPolicy(cfg Config) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		maxAttempts:  cfg.RetryMaxAttempts,
+		statuses:     map[int]bool{},
+		grpcStatuses: map[codes.Code]bool{},
+		backoffBase:  cfg.RetryBackoffBase,
+		backoffMax:   cfg.RetryBackoffMax,
+	}
+	for _, on := range strings.Split(cfg.RetryOn, ",") {
+		switch on = strings.TrimSpace(on); on {
+		case "":
+		case "error":
+			policy.onError = true
+		case "connect-failure":
+			policy.onConnectFailure = true
+		case "5xx":
+			policy.on5xx = true
+		default:
+			if name, ok := strings.CutPrefix(on, "grpc-"); ok {
+				code, ok := parseGRPCStatus(name)
+				if !ok {
+					return nil, fmt.Errorf("[newRetryPolicy] -> unknown gRPC status: `%s`", on)
+				}
+				policy.grpcStatuses[code] = true
+				continue
+			}
+			status, err := strconv.Atoi(on)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("[newRetryPolicy] -> invalid retry condition: `%s`", on)
+			}
+			policy.statuses[status] = true
+		}
+	}
+	return policy, nil
+}
+
+// Returns why the outcome of an attempt should be retried or an empty string if
+// it shouldn't be
+func (p *retryPolicy) retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		var opErr *net.OpError
+		if p.onConnectFailure && errors.As(err, &opErr) && opErr.Op == "dial" {
+			return "connect-failure"
+		}
+		if p.onError && !isResponseHeaderTimeout(err) {
+			return "error"
+		}
+		return ""
+	}
+	if code, ok := grpcStatus(resp); ok && isGRPC(resp.Header) {
+		if p.grpcStatuses[code] {
+			return "grpc-" + GRPC_STATUS_NAMES[code]
+		}
+		return ""
+	}
+	if p.statuses[resp.StatusCode] || (p.on5xx && resp.StatusCode >= 500 && resp.StatusCode <= 599) {
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// Whether `err` is the transport giving up on an instance's response headers.
+// net/http doesn't export the error, so it is told apart by its message
+func isResponseHeaderTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() && strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+// Exponential backoff with full jitter - a random duration between 0 and
+// backoffBase x 2^(retry-1), capped at backoffMax
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	ceiling := p.backoffMax
+	if retry < 32 {
+		ceiling = min(p.backoffBase<<(retry-1), p.backoffMax)
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// Number of one second buckets the retry budget keeps track of
+const RETRY_BUDGET_WINDOW = 10
+
+// Caps retries across all requests so that they can't pile onto an outage.
+// Over a sliding window of RETRY_BUDGET_WINDOW seconds retries may make up at
+// most `ratio` of requests, plus `minPerSecond` retries every second so that
+// low traffic can still be retried
+type retryBudget struct {
+	mx           sync.Mutex
+	ratio        float64
+	minPerSecond float64
+	buckets      [RETRY_BUDGET_WINDOW]retryBucket
+}
+
+type retryBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+func newRetryBudget(ratio, minPerSecond float64) *retryBudget {
+	return &retryBudget{ratio: ratio, minPerSecond: minPerSecond}
+}
+
+// Returns the bucket for the current second, resetting it if it is stale.
+// Must be called with b.mx held
+func (b *retryBudget) bucket(now time.Time) *retryBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%RETRY_BUDGET_WINDOW]
+	if bucket.second != second {
+		*bucket = retryBucket{second: second}
+	}
+	return bucket
+}
+
+// Records a request. Every request adds to the retries allowed
+func (b *retryBudget) deposit(now time.Time) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.bucket(now).requests += 1
+}
+
+// Records a retry if the budget allows it. Returns false if it doesn't
+func (b *retryBudget) withdraw(now time.Time) bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	requests, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if now.Unix()-bucket.second < RETRY_BUDGET_WINDOW {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed := b.ratio*float64(requests) + b.minPerSecond*RETRY_BUDGET_WINDOW
+	if float64(retries+1) > allowed {
+		return false
+	}
+	b.bucket(now).retries += 1
+	return true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	policy, err := newRetryPolicy(Config{RetryMaxAttempts: 3, RetryOn: "connect-failure, 5xx,429"})
+	if err != nil {
+		t.Fatal("newRetryPolicy should not error here: ", err)
+	}
+	if policy.onError || !policy.onConnectFailure || !policy.on5xx || !policy.statuses[429] {
+		t.Errorf("retry conditions were not parsed correctly: %+v\n", policy)
+	}
+
+	for _, on := range []string{"errors", "600", "abc"} {
+		_, err := newRetryPolicy(Config{RetryOn: on})
+		if err == nil || !strings.HasPrefix(err.Error(), "[newRetryPolicy] -> invalid retry condition: ") {
+			t.Errorf("`%s` should be rejected. Actual: %v\n", on, err)
+		}
+	}
+}
+
+func TestRetryPolicyRetryReason(t *testing.T) {
+	dialErr := &url.Error{Op: "Get", URL: "http://x", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	readErr := &url.Error{Op: "Get", URL: "http://x", Err: errors.New("EOF")}
+	response := func(status int) *http.Response { return &http.Response{StatusCode: status} }
+
+	policy, _ := newRetryPolicy(Config{RetryOn: "connect-failure,503"})
+	cases := []struct {
+		resp     *http.Response
+		err      error
+		expected string
+	}{
+		{nil, dialErr, "connect-failure"},
+		{nil, readErr, ""},
+		{response(503), nil, "503"},
+		{response(502), nil, ""},
+		{response(200), nil, ""},
+	}
+	for _, c := range cases {
+		if actual := policy.retryReason(c.resp, c.err); actual != c.expected {
+			t.Errorf("Expected: `%s`, Actual: `%s` for %v %v\n", c.expected, actual, c.resp, c.err)
+		}
+	}
+
+	policy, _ = newRetryPolicy(Config{RetryOn: "error,5xx"})
+	if policy.retryReason(nil, readErr) != "error" || policy.retryReason(response(502), nil) != "502" {
+		t.Error("`error` and `5xx` should retry any error and any 5xx")
+	}
+	if policy.retryReason(response(404), nil) != "" {
+		t.Error("4xx should not be retried")
+	}
+}
+
+func TestRetryPolicySkipsResponseHeaderTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	instance := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer instance.Close()
+	defer close(release)
+
+	transport := newUpstreamTransport(Config{UpstreamResponseHeaderTimeout: time.Millisecond * 50}.withDefaults(), nil)
+	defer transport.CloseIdleConnections()
+	_, err := (&http.Client{Transport: transport}).Get(instance.URL)
+	if err == nil {
+		t.Fatal("request should time out waiting for the response headers")
+	}
+
+	policy, _ := newRetryPolicy(Config{RetryOn: "error"})
+	if reason := policy.retryReason(nil, err); reason != "" {
+		t.Errorf("instance may still be working on the request and should not be retried. Actual: `%s`\n", reason)
+	}
+	if !isResponseHeaderTimeout(err) {
+		t.Error("timeout should be recognised. Actual: ", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &retryPolicy{backoffBase: time.Millisecond * 100, backoffMax: time.Millisecond * 300}
+	for range 100 {
+		for retry, ceiling := range map[int]time.Duration{1: 100, 2: 200, 3: 300, 10: 300, 100: 300} {
+			if backoff := policy.backoff(retry); backoff < 0 || backoff > ceiling*time.Millisecond {
+				t.Fatalf("backoff for retry %d should be within [0, %dms]. Actual: %s\n", retry, ceiling, backoff)
+			}
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1000, 0)
+	budget := newRetryBudget(0.2, 0.5) // 5 retries per window regardless of traffic
+
+	for range 5 {
+		if !budget.withdraw(now) {
+			t.Fatal("minimum retries should be allowed without any traffic")
+		}
+	}
+	if budget.withdraw(now) {
+		t.Fatal("retries above the minimum should need traffic")
+	}
+
+	for range 100 {
+		budget.deposit(now)
+	}
+	allowed := 0
+	for budget.withdraw(now) {
+		allowed += 1
+	}
+	if allowed != 20 {
+		t.Errorf("100 requests should allow 20 more retries. Actual: %d\n", allowed)
+	}
+
+	// Old requests and retries fall out of the window
+	later := now.Add(time.Second * RETRY_BUDGET_WINDOW)
+	allowed = 0
+	for budget.withdraw(later) {
+		allowed += 1
+	}
+	if allowed != 5 {
+		t.Errorf("only minimum retries should be allowed once the window has passed. Actual: %d\n", allowed)
+	}
+}
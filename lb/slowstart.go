@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Slow start ramps up the share of traffic an instance gets after it has been
+// added or has recovered, so that cold caches and the like aren't hit with a
+// full share straight away.
+// Over `window` the instance's weight grows from `minFraction` of its weight to
+// all of it. With an `aggression` of 1 the ramp is linear, higher values ramp up
+// faster early on and lower ones slower
+type slowStart struct {
+	window      time.Duration
+	minFraction float64
+	aggression  float64
+}
+
+func newSlowStart(cfg Config) *slowStart {
+	if cfg.SlowStartWindow <= 0 {
+		return nil
+	}
+	return &slowStart{
+		window:      cfg.SlowStartWindow,
+		minFraction: float64(cfg.SlowStartMinWeightPercent) / 100,
+		aggression:  cfg.SlowStartAggression,
+	}
+}
+
+// Fraction of its weight an instance gets `elapsed` after it turned healthy
+func (ss *slowStart) factor(elapsed time.Duration) float64 {
+	if ss == nil || elapsed >= ss.window {
+		return 1
+	}
+	progress := float64(max(elapsed, 0)) / float64(ss.window)
+	return max(ss.minFraction, math.Pow(progress, 1/ss.aggression))
+}
+
+// Balancers that account for slow start in their own picks. Picks of all other
+// balancers are thinned out by the LB instead
+type slowStartAware interface {
+	handlesSlowStart()
+}
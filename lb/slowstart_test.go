@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSlowStartFactor(t *testing.T) {
+	if newSlowStart(Config{}.withDefaults()) != nil {
+		t.Fatal("slow start should be disabled by default")
+	}
+
+	linear := newSlowStart(Config{SlowStartWindow: time.Second * 10}.withDefaults())
+	cases := map[time.Duration]float64{
+		0:                0.1, // Never below the minimum weight
+		time.Second * 5:  0.5,
+		time.Second * 10: 1,
+		time.Second * 20: 1,
+	}
+	for elapsed, expected := range cases {
+		if got := linear.factor(elapsed); math.Abs(got-expected) > 1e-9 {
+			t.Errorf("linear factor after %s. Expected: %f. Actual: %f", elapsed, expected, got)
+		}
+	}
+
+	aggressive := newSlowStart(Config{SlowStartWindow: time.Second * 10, SlowStartAggression: 2}.withDefaults())
+	if got := aggressive.factor(time.Second * 5); got <= 0.5 {
+		t.Errorf("aggressive ramp should be ahead of linear half way through. Actual: %f", got)
+	}
+
+	var disabled *slowStart
+	if disabled.factor(0) != 1 {
+		t.Error("disabled slow start should not reduce weight")
+	}
+}
+
+func TestSlowStartEffectiveWeight(t *testing.T) {
+	ins := &Instance{url: "a", weight: 4, slowStart: newSlowStart(Config{SlowStartWindow: time.Second * 10}.withDefaults())}
+	now := time.Now()
+	if ins.effectiveWeight(now) != 4 {
+		t.Error("instance that never turned healthy should have its full weight")
+	}
+
+	ins.healthySince.Store(now.UnixNano())
+	if got := ins.effectiveWeight(now.Add(time.Second * 5)); math.Abs(got-2) > 1e-9 {
+		t.Errorf("Expected effective weight: 2. Actual: %f", got)
+	}
+	if got := ins.effectiveWeight(now.Add(time.Minute)); got != 4 {
+		t.Errorf("Expected effective weight after the window: 4. Actual: %f", got)
+	}
+}
+
+func TestWeightedRoundRobinSlowStart(t *testing.T) {
+	instances := testInstances(2)
+	ss := newSlowStart(Config{SlowStartWindow: time.Hour, SlowStartMinWeightPercent: 25}.withDefaults())
+	for _, ins := range instances {
+		ins.slowStart = ss
+	}
+	instances[1].healthySince.Store(time.Now().UnixNano())
+
+	b, _ := NewBalancer(Config{Balancer: WEIGHTED_BALANCER})
+	counts := map[*Instance]int{}
+	for range 500 {
+		counts[b.Pick(instances, nil)]++
+	}
+	// Weights 1 and 0.25
+	if counts[instances[0]] != 400 || counts[instances[1]] != 100 {
+		t.Errorf("Expected 400/100 picks. Actual: %d/%d", counts[instances[0]], counts[instances[1]])
+	}
+}
+
+func TestLBSlowStartThinsOutPicks(t *testing.T) {
+	lb, err := NewLBWithConfig(context.Background(), Config{Balancer: LEAST_CONN_BALANCER})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.slowStart = newSlowStart(Config{SlowStartWindow: time.Hour, SlowStartMinWeightPercent: 20}.withDefaults())
+	instances := testInstances(2)
+	for _, ins := range instances {
+		ins.slowStart = lb.slowStart
+	}
+	instances[1].healthySince.Store(time.Now().UnixNano())
+	lb.instances = instances
+
+	counts := map[*Instance]int{}
+	for range 2000 {
+		counts[lb.GetInstance()]++
+	}
+	// Without slow start both would get about half
+	if counts[instances[1]] == 0 || counts[instances[1]] > 500 {
+		t.Errorf("Expected the slow starting instance to get a reduced share. Actual: %d of 2000", counts[instances[1]])
+	}
+
+	// With nothing else left it is still used
+	instances[0].healthy = false
+	for range 20 {
+		if lb.GetInstance() != instances[1] {
+			t.Fatal("slow starting instance should be used when it is the only one available")
+		}
+	}
+}
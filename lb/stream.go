@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writes a response body to the client and flushes it as it goes, so that
+// streamed responses reach the client while the instance is still sending them.
+// A negative interval flushes after every write, a positive one at most that
+// long after data has been written
+type flushWriter struct {
+	mx       sync.Mutex
+	res      http.ResponseWriter
+	rc       *http.ResponseController
+	interval time.Duration
+	timer    *time.Timer
+	pending  bool // Whether data has been written since the last flush
+}
+
+func newFlushWriter(res http.ResponseWriter, interval time.Duration) *flushWriter {
+	return &flushWriter{res: res, rc: http.NewResponseController(res), interval: interval}
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	n, err := w.res.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if w.interval < 0 {
+		return n, w.flush()
+	}
+	if !w.pending {
+		w.pending = true
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.interval, w.delayedFlush)
+		} else {
+			w.timer.Reset(w.interval)
+		}
+	}
+	return n, nil
+}
+
+func (w *flushWriter) delayedFlush() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if w.pending {
+		w.flush()
+	}
+}
+
+// Must be called with w.mx held
+func (w *flushWriter) flush() error {
+	w.pending = false
+	if err := w.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// Stops pending flushes. The writer must not be used afterwards
+func (w *flushWriter) stop() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	w.pending = false
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// How often a response should be flushed to the client. Streams of unknown
+// length, like Server-Sent Events, are flushed after every write regardless
+// of the configured interval
+func flushIntervalFor(resp *http.Response, configured time.Duration) time.Duration {
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return -1
+	}
+	return configured
+}
+
+// Comma separated tokens of all `values` of a header, lower cased
+func headerTokens(values []string) []string {
+	tokens := []string{}
+	for _, v := range values {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
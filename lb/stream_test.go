@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sets G_LB up with `cfg` and adds the instances at `specs` the way the API
+// does. They are healthy from the start and, unless `cfg` says otherwise, not
+// health checked while the test runs
+func newTestLB(t *testing.T, cfg Config, specs ...string) {
+	t.Helper()
+	if cfg.HealthCheckInterval == 0 {
+		cfg.HealthCheckInterval = time.Hour
+	}
+	var err error
+	G_LB, err = NewLBWithConfig(t.Context(), cfg)
+	if err != nil {
+		t.Fatal("NewLB should not error here: ", err)
+	}
+	for _, spec := range specs {
+		if err := G_LB.AddInstance(spec); err != nil {
+			t.Fatal("AddInstance should not error here: ", err)
+		}
+	}
+	for _, ins := range G_LB.instances {
+		ins.healthy = true
+	}
+}
+
+// Serves proxyHandler with a single instance behind it
+func newStreamingProxy(t *testing.T, cfg Config, upstream http.Handler) *httptest.Server {
+	t.Helper()
+	instance := httptest.NewServer(upstream)
+	t.Cleanup(instance.Close)
+	newTestLB(t, cfg, instance.URL)
+
+	proxy := httptest.NewServer(http.HandlerFunc(proxyHandler))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestProxyStreamsServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.Header().Set("Content-Length", "1000") // Not a chunked stream, flushed for being an event stream
+		res.WriteHeader(http.StatusOK)
+		io.WriteString(res, "data: first\n\n")
+		res.(http.Flusher).Flush()
+		<-release
+	}))
+	defer close(release)
+
+	resp, err := http.Get(proxy.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line := make(chan string)
+	go func() {
+		l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- l
+	}()
+	select {
+	case l := <-line:
+		if l != "data: first\n" {
+			t.Errorf("Expected the first event. Actual: `%s`", l)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("first event should reach the client while the instance is still streaming")
+	}
+}
+
+func TestProxyStreamsChunkedUploads(t *testing.T) {
+	firstChunk := make(chan string)
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.ContentLength != -1 {
+			t.Errorf("upload of unknown length should be forwarded chunked. Content-Length: %d", req.ContentLength)
+		}
+		buf := make([]byte, 5)
+		io.ReadFull(req.Body, buf)
+		firstChunk <- string(buf)
+		rest, _ := io.ReadAll(req.Body)
+		res.Write(append(buf, rest...))
+	}))
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hello"))
+		// The rest is only sent once the instance has received the start
+		select {
+		case chunk := <-firstChunk:
+			if chunk != "hello" {
+				t.Errorf("Expected the first chunk. Actual: `%s`", chunk)
+			}
+		case <-time.After(time.Second * 2):
+			t.Error("first chunk should reach the instance before the upload is complete")
+		}
+		pw.Write([]byte(" world"))
+		pw.Close()
+	}()
+
+	resp, err := http.Post(proxy.URL+"/upload", "text/plain", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello world" {
+		t.Errorf("Expected: `hello world`. Actual: `%s`", body)
+	}
+}
+
+func TestProxyStreamsFullDuplex(t *testing.T) {
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.NewResponseController(res).EnableFullDuplex()
+		res.WriteHeader(http.StatusOK)
+		res.(http.Flusher).Flush()
+		lines := bufio.NewReader(req.Body)
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(res, line)
+			res.(http.Flusher).Flush()
+		}
+	}))
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	responded := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(proxy.URL+"/echo", "text/plain", pr)
+		if err != nil {
+			t.Error(err)
+			close(responded)
+			return
+		}
+		responded <- resp
+	}()
+
+	// Each message is only sent once the previous one has been echoed back
+	pw.Write([]byte("message 0\n"))
+	var resp *http.Response
+	select {
+	case resp = <-responded:
+		if resp == nil {
+			t.FailNow()
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("response should be relayed while the request body is still open")
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+	for i := range 3 {
+		if i > 0 {
+			fmt.Fprintf(pw, "message %d\n", i)
+		}
+		line := make(chan string)
+		go func() {
+			l, _ := lines.ReadString('\n')
+			line <- l
+		}()
+		select {
+		case l := <-line:
+			if l != fmt.Sprintf("message %d\n", i) {
+				t.Fatalf("Expected: `message %d`. Actual: `%s`", i, l)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("message %d should be echoed back while the request body is still open", i)
+		}
+	}
+}
+
+func TestProxyStreamsChunkedDownloads(t *testing.T) {
+	release := make(chan struct{})
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, strings.Repeat("a", 10))
+		res.(http.Flusher).Flush()
+		<-release
+		io.WriteString(res, strings.Repeat("b", 10))
+	}))
+
+	resp, err := http.Get(proxy.URL + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != strings.Repeat("a", 10) {
+		t.Fatalf("first chunk should arrive before the download is complete. Actual: `%s`, %v", buf, err)
+	}
+	close(release)
+	rest, _ := io.ReadAll(resp.Body)
+	if string(rest) != strings.Repeat("b", 10) {
+		t.Errorf("Expected the second chunk. Actual: `%s`", rest)
+	}
+}
+
+func TestProxyPropagatesCancellation(t *testing.T) {
+	cancelled := make(chan struct{})
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+		res.(http.Flusher).Flush()
+		<-req.Context().Done()
+		close(cancelled)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, proxy.URL+"/long", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second * 2):
+		t.Fatal("request to the instance should be cancelled when the client goes away")
+	}
+}
+
+func TestProxyForwardsTrailersTE(t *testing.T) {
+	proxy := newStreamingProxy(t, Config{}, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, req.Header.Get("Te")+"|"+req.Header.Get("Connection"))
+	}))
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/", nil)
+	req.Header.Set("Te", "trailers, deflate")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "trailers|" {
+		t.Errorf("only `TE: trailers` should be passed on. Actual: `%s`", body)
+	}
+}
+
+func TestFlushWriterInterval(t *testing.T) {
+	rr := httptest.NewRecorder()
+	fw := newFlushWriter(rr, time.Millisecond*20)
+	defer fw.stop()
+
+	flushed := func() bool {
+		fw.mx.Lock()
+		defer fw.mx.Unlock()
+		return rr.Flushed
+	}
+
+	fw.Write([]byte("data"))
+	if flushed() {
+		t.Fatal("write should not be flushed before the interval")
+	}
+	time.Sleep(time.Millisecond * 100)
+	if !flushed() {
+		t.Error("write should be flushed once the interval has passed")
+	}
+
+	immediate := httptest.NewRecorder()
+	newFlushWriter(immediate, -1).Write([]byte("data"))
+	if !immediate.Flushed {
+		t.Error("negative interval should flush after every write")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"time"
+)
+
+const DEFAULT_UPSTREAM_MAX_IDLE_CONNS = 1024
+const DEFAULT_UPSTREAM_MAX_IDLE_CONNS_PER_HOST = 64
+const DEFAULT_UPSTREAM_IDLE_CONN_TIMEOUT = time.Second * 90
+const DEFAULT_UPSTREAM_DIAL_TIMEOUT = time.Second * 5
+const DEFAULT_UPSTREAM_KEEP_ALIVE = time.Second * 30
+const DEFAULT_UPSTREAM_TLS_HANDSHAKE_TIMEOUT = time.Second * 10
+
+// HTTP versions an instance can be spoken to with
+const HTTP1_PROTOCOL = "http1"
+const H2_PROTOCOL = "h2"
+const H2C_PROTOCOL = "h2c"
+
+// Used by instances that don't belong to an LB
+var defaultUpstreamTransport = newUpstreamTransport(Config{}.withDefaults(), nil)
+
+// Builds the transport all requests to the instances of an LB - proxied ones
+// and health checks alike - go through, so that connections to an instance
+// are pooled and kept alive between requests. `tlsConfig` applies to `https`
+// instances
+func newUpstreamTransport(cfg Config, tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.UpstreamDialTimeout,
+		KeepAlive: cfg.UpstreamKeepAlive,
+	}
+	return &http.Transport{
+		Proxy: nil, // The instances are reached directly
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			result := "success"
+			if err != nil {
+				result = "error"
+			}
+			UPSTREAM_DIALS_METRIC.WithLabelValues(result).Inc()
+			return conn, err
+		},
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          cfg.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.UpstreamMaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.UpstreamIdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.UpstreamTLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.UpstreamResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// Counts whether requests to the instance at `url` got a pooled connection or
+// a new one
+func withConnTrace(ctx context.Context, url string) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused := "false"
+			if info.Reused {
+				reused = "true"
+			}
+			UPSTREAM_CONNECTIONS_METRIC.WithLabelValues(url, reused).Inc()
+		},
+	})
+}
+
+// Builds the TLS configuration used with `https` instances - the CAs their
+// certificates are verified against, the server name they are expected to
+// have and the certificate the LB authenticates itself with
+func newUpstreamTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.UpstreamServerName,
+		InsecureSkipVerify: cfg.UpstreamInsecureSkipVerify,
+	}
+	if cfg.UpstreamCAFile != "" {
+		bs, err := os.ReadFile(cfg.UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("[newUpstreamTLSConfig] -> error reading CA file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("[newUpstreamTLSConfig] -> no PEM certificates in CA file: `%s`", cfg.UpstreamCAFile)
+		}
+	}
+	if (cfg.UpstreamClientCertFile == "") != (cfg.UpstreamClientKeyFile == "") {
+		return nil, fmt.Errorf("[newUpstreamTLSConfig] -> client certificate and key have to be set together")
+	}
+	if cfg.UpstreamClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.UpstreamClientCertFile, cfg.UpstreamClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("[newUpstreamTLSConfig] -> error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// A copy of `transport` that expects instances to have `serverName` in their
+// TLS handshake. It has its own connection pool
+func withServerName(transport *http.Transport, serverName string) *http.Transport {
+	t := transport.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	t.TLSClientConfig.ServerName = serverName
+	return t
+}
+
+// HTTP/2 needs TLS to be negotiated, h2c is HTTP/2 without it
+func validProtocol(protocol, scheme string) bool {
+	switch protocol {
+	case HTTP1_PROTOCOL:
+		return true
+	case H2_PROTOCOL:
+		return scheme == "https"
+	case H2C_PROTOCOL:
+		return scheme == "http"
+	}
+	return false
+}
+
+// A copy of `transport` that speaks `protocol` to instances. HTTP/2
+// multiplexes all requests to an instance over as few connections as
+// possible, so it has its own connection pool. h2c connections are made with
+// prior knowledge, without an upgrade from HTTP/1.1
+func withProtocol(transport *http.Transport, protocol string) *http.Transport {
+	t := transport.Clone()
+	t.Protocols = &http.Protocols{}
+	switch protocol {
+	case H2_PROTOCOL:
+		t.Protocols.SetHTTP2(true)
+	case H2C_PROTOCOL:
+		t.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		t.Protocols.SetHTTP1(true)
+	}
+	return t
+}
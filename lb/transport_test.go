@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpstreamTransportReusesConnections(t *testing.T) {
+	dials := atomic.Int64{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	lb, err := NewLBWithConfig(t.Context(), Config{UpstreamIdleConnTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.AddInstance("http://localhost:1"); err != nil {
+		t.Fatal(err)
+	}
+	if lb.instances[0].transport != lb.transport || lb.healthCheck.transport != lb.transport {
+		t.Fatal("instances and health checks should share the LB's transport")
+	}
+
+	ins, err := NewInstance(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins.transport = lb.transport
+	reusedBefore := testutil.ToFloat64(UPSTREAM_CONNECTIONS_METRIC.WithLabelValues(ins.url, "true"))
+	for range 5 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		resp, err := ins.roundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	hc := *lb.healthCheck
+	hc.timeout = time.Second
+	if err := hc.check(t.Context(), HTTP_HEALTH_CHECK, ins.url); err != nil {
+		t.Fatal(err)
+	}
+
+	if dials.Load() != 1 {
+		t.Errorf("all requests should share one connection. Actual connections: %d", dials.Load())
+	}
+	if reused := testutil.ToFloat64(UPSTREAM_CONNECTIONS_METRIC.WithLabelValues(ins.url, "true")) - reusedBefore; reused != 5 {
+		t.Errorf("Expected 5 reused connections. Actual: %v", reused)
+	}
+}
+
+func TestUpstreamTransportConfig(t *testing.T) {
+	transport := newUpstreamTransport(Config{
+		UpstreamMaxIdleConnsPerHost:   8,
+		UpstreamResponseHeaderTimeout: time.Second * 3,
+	}.withDefaults(), nil)
+	if transport.MaxIdleConnsPerHost != 8 || transport.ResponseHeaderTimeout != time.Second*3 {
+		t.Error("transport should be configured from the config")
+	}
+	if transport.IdleConnTimeout != DEFAULT_UPSTREAM_IDLE_CONN_TIMEOUT || transport.TLSHandshakeTimeout != DEFAULT_UPSTREAM_TLS_HANDSHAKE_TIMEOUT {
+		t.Error("unset values should fall back to their defaults")
+	}
+	if newUpstreamTransport(Config{}.withDefaults(), nil).ResponseHeaderTimeout != 0 {
+		t.Error("response header timeout should be disabled unless set")
+	}
+}
+
+// Certificate authority for tests that issues server and client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issues a certificate for `commonName` with `dnsNames` and 127.0.0.1 as
+// SANs. Returns it as a tls.Certificate and PEM encoded certificate and key
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames ...string) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Proxies a request to the instance at `url` through an LB configured with `cfg`
+func proxyTo(t *testing.T, cfg Config, spec string) (*http.Response, error) {
+	t.Helper()
+	lb, err := NewLBWithConfig(t.Context(), cfg)
+	if err != nil {
+		t.Fatal("NewLB should not error here: ", err)
+	}
+	if err := lb.AddInstance(spec); err != nil {
+		t.Fatal("AddInstance should not error here: ", err)
+	}
+	resp, err := lb.instances[0].roundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err == nil {
+		t.Cleanup(func() { resp.Body.Close() })
+	}
+	return resp, err
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	serverNames := make(chan string, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		serverNames <- req.TLS.ServerName
+		res.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	caFile := writeTestFile(t, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	// Unknown CA
+	if _, err := proxyTo(t, Config{}, server.URL); err == nil {
+		t.Error("certificate from an unknown CA should be rejected")
+	}
+
+	// Custom root CA
+	resp, err := proxyTo(t, Config{UpstreamCAFile: caFile}, server.URL)
+	if err != nil {
+		t.Fatal("certificate from the configured CA should be accepted: ", err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("Expected: `ok`. Actual: `%s`", body)
+	}
+	<-serverNames
+
+	// SNI override. The test certificate is valid for example.com
+	if _, err := proxyTo(t, Config{UpstreamCAFile: caFile}, server.URL+";sni=example.com"); err != nil {
+		t.Fatal("server name on the certificate should be accepted: ", err)
+	}
+	if name := <-serverNames; name != "example.com" {
+		t.Errorf("Expected SNI: `example.com`. Actual: `%s`", name)
+	}
+	if _, err := proxyTo(t, Config{UpstreamCAFile: caFile, UpstreamServerName: "other.com"}, server.URL); err == nil {
+		t.Error("server name not on the certificate should be rejected")
+	}
+
+	// Insecure skip verify
+	if _, err := proxyTo(t, Config{UpstreamInsecureSkipVerify: true}, server.URL); err != nil {
+		t.Error("any certificate should be accepted when verification is skipped: ", err)
+	}
+}
+
+func TestHTTPSUpstreamClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.issue(t, "instance", "instance.local")
+	_, clientCertPEM, clientKeyPEM := ca.issue(t, "lb")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := Config{UpstreamCAFile: writeTestFile(t, "ca.pem", ca.pem)}
+	if _, err := proxyTo(t, cfg, server.URL); err == nil {
+		t.Error("instance requiring a client certificate should reject the LB without one")
+	}
+
+	cfg.UpstreamClientCertFile = writeTestFile(t, "client.pem", clientCertPEM)
+	cfg.UpstreamClientKeyFile = writeTestFile(t, "client-key.pem", clientKeyPEM)
+	resp, err := proxyTo(t, cfg, server.URL)
+	if err != nil {
+		t.Fatal("client certificate should be accepted: ", err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "lb" {
+		t.Errorf("instance should see the LB's certificate. Actual: `%s`", body)
+	}
+
+	// Health checks go through the same TLS configuration
+	lb, _ := NewLBWithConfig(t.Context(), cfg)
+	hc := *lb.healthCheck
+	hc.path = "/"
+	hc.timeout = time.Second
+	if err := hc.check(t.Context(), HTTP_HEALTH_CHECK, server.URL); err != nil {
+		t.Error("health check should pass with the client certificate: ", err)
+	}
+}
+
+func TestNewUpstreamTLSConfigErrors(t *testing.T) {
+	cases := []Config{
+		{UpstreamCAFile: "/does/not/exist"},
+		{UpstreamCAFile: writeTestFile(t, "ca.pem", []byte("not a certificate"))},
+		{UpstreamClientCertFile: "cert.pem"},
+	}
+	for _, cfg := range cases {
+		if _, err := newUpstreamTLSConfig(cfg); err == nil {
+			t.Errorf("config should be rejected: %+v", cfg)
+		}
+	}
+}
+
+func TestUpstreamProtocols(t *testing.T) {
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.Proto))
+	})
+
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = &http.Protocols{}
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	cases := map[string]string{
+		h2c.URL:                "HTTP/1.1",
+		h2c.URL + ";proto=h2c": "HTTP/2.0",
+		h2.URL:                 "HTTP/1.1",
+		h2.URL + ";proto=h2":   "HTTP/2.0",
+	}
+	for spec, expected := range cases {
+		resp, err := proxyTo(t, Config{UpstreamInsecureSkipVerify: true}, spec)
+		if err != nil {
+			t.Fatalf("`%s` - request should succeed: %s\n", spec, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != expected || resp.Proto != expected {
+			t.Errorf("`%s` - Expected: `%s`. Actual: `%s`, instance saw `%s`\n", spec, expected, resp.Proto, body)
+		}
+	}
+	if n := testutil.ToFloat64(UPSTREAM_PROTOCOL_METRIC.WithLabelValues(h2.URL, "HTTP/2.0")); n < 1 {
+		t.Error("HTTP/2 responses should be counted per instance")
+	}
+
+	// Concurrent requests are multiplexed over one connection
+	lb, _ := NewLBWithConfig(t.Context(), Config{UpstreamInsecureSkipVerify: true})
+	lb.AddInstance(h2.URL + ";proto=h2")
+	before := testutil.ToFloat64(UPSTREAM_CONNECTIONS_METRIC.WithLabelValues(h2.URL, "false"))
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := lb.instances[0].roundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+			if err != nil {
+				t.Error("request should succeed: ", err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if dials := testutil.ToFloat64(UPSTREAM_CONNECTIONS_METRIC.WithLabelValues(h2.URL, "false")) - before; dials > 1 {
+		t.Errorf("HTTP/2 requests should share a connection. New connections: %v\n", dials)
+	}
+}
+
+func TestRemoveInstanceClosesOwnTransport(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	h2c := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	}))
+	h2c.Config.Protocols = &http.Protocols{}
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	h2c.Start()
+	defer h2c.Close()
+
+	lb, _ := NewLBWithConfig(t.Context(), Config{HealthCheckInterval: time.Hour})
+	if err := lb.AddInstance(h2c.URL + ";proto=h2c"); err != nil {
+		t.Fatal("AddInstance should not error here: ", err)
+	}
+	ins := lb.instances[0]
+	if ins.transport == lb.transport {
+		t.Fatal("h2c instance should have a transport of its own")
+	}
+	resp, err := ins.roundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal("request should succeed: ", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	lb.RemoveInstance(h2c.URL)
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 2):
+		t.Error("idle connections to a removed instance should be closed")
+	}
+}
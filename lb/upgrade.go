@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_UPGRADE_DRAIN_TIMEOUT = time.Second * 10
+
+// Protocol `h` asks to switch to - eg. `websocket` - or empty if it doesn't
+// ask to switch protocols
+func upgradeType(h http.Header) string {
+	if !slices.Contains(headerTokens(h.Values("Connection")), "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// A client connection that switched protocols, spliced to the instance
+type splicedConn struct {
+	client  net.Conn
+	backend io.ReadWriteCloser
+	done    chan struct{} // Closed once either side has gone away
+}
+
+func (c *splicedConn) close() {
+	c.client.Close()
+	c.backend.Close()
+}
+
+// The upgraded connections of an instance. Once draining no new ones are
+// taken on
+type upgradedConns struct {
+	mx       sync.Mutex
+	conns    map[*splicedConn]struct{}
+	draining bool
+}
+
+// Reports false if the instance is being drained, in which case `c` should
+// be closed right away
+func (u *upgradedConns) add(c *splicedConn) bool {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	if u.draining {
+		return false
+	}
+	if u.conns == nil {
+		u.conns = map[*splicedConn]struct{}{}
+	}
+	u.conns[c] = struct{}{}
+	return true
+}
+
+func (u *upgradedConns) remove(c *splicedConn) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	delete(u.conns, c)
+}
+
+// Number of upgraded connections currently open
+func (u *upgradedConns) count() int {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	return len(u.conns)
+}
+
+// Stops taking on upgraded connections and gives the open ones `timeout` to
+// finish on their own. Those still open after that are closed
+func (u *upgradedConns) drain(timeout time.Duration) {
+	u.mx.Lock()
+	u.draining = true
+	conns := make([]*splicedConn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	u.mx.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for _, c := range conns {
+		select {
+		case <-c.done:
+		case <-deadline.C:
+			// Let the rest through without waiting
+			deadline.Reset(0)
+			c.close()
+		}
+	}
+}
+
+// Relays the `101 Switching Protocols` response of the instance and splices
+// the client connection to the instance's until either side goes away. The
+// instance has to switch to the protocol the client asked for
+func (ins *Instance) splice(res http.ResponseWriter, req *http.Request, resp *http.Response) {
+	requested := upgradeType(req.Header)
+	switched := resp.Header.Get("Upgrade")
+	if !strings.EqualFold(requested, switched) {
+		logRequest(req, "[Instance.splice] -> `%s` switched to `%s` instead of `%s`\n", ins.url, switched, requested)
+		writeError(res, req, http.StatusBadGateway, "instance switched to an unexpected protocol")
+		return
+	}
+	// The connection to the instance. It stays in flight until resp.Body is closed
+	body := resp.Body
+	if b, ok := body.(*inFlightBody); ok {
+		body = b.ReadCloser
+	}
+	backend, ok := body.(io.ReadWriteCloser)
+	if !ok {
+		logRequest(req, "[Instance.splice] -> connection to `%s` can't be spliced\n", ins.url)
+		writeError(res, req, http.StatusBadGateway, "error upgrading connection")
+		return
+	}
+	conn, brw, err := http.NewResponseController(res).Hijack()
+	if err != nil {
+		logRequest(req, "[Instance.splice] -> error taking over the client connection: %s\n", err)
+		writeError(res, req, http.StatusInternalServerError, "error upgrading connection")
+		return
+	}
+	defer conn.Close()
+
+	rule := ins.headerPolicy.ruleFor(req.URL.Path)
+	removeHopHeaders(resp.Header)
+	rule.filterResponse(resp.Header)
+	copyHeader(res.Header(), resp.Header)
+	res.Header().Set("Connection", "Upgrade")
+	res.Header().Set("Upgrade", switched)
+	switching := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     res.Header(),
+	}
+	if err := switching.Write(brw); err != nil {
+		logRequest(req, "[Instance.splice] -> error writing response: %s\n", err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		logRequest(req, "[Instance.splice] -> error writing response: %s\n", err)
+		return
+	}
+	RESPONSE_STATUS_METRIC.WithLabelValues(fmt.Sprintf("%d", http.StatusSwitchingProtocols)).Inc()
+	logRequest(req, "[Instance.splice] -> %s %s switched to `%s` at: `%s`\n", req.Method, req.URL.Path, switched, ins.url)
+
+	spliced := &splicedConn{client: conn, backend: backend, done: make(chan struct{})}
+	if !ins.upgrades.add(spliced) {
+		logRequest(req, "[Instance.splice] -> `%s` is draining. Closing the connection\n", ins.url)
+		return
+	}
+	UPGRADED_CONNECTIONS_METRIC.WithLabelValues(ins.url).Inc()
+	defer func() {
+		ins.upgrades.remove(spliced)
+		UPGRADED_CONNECTIONS_METRIC.WithLabelValues(ins.url).Dec()
+	}()
+
+	// Whatever the client sent after its request is still in brw's buffer
+	copied := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backend, brw.Reader)
+		copied <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backend)
+		copied <- err
+	}()
+	<-copied
+	close(spliced.done)
+	spliced.close()
+	<-copied
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Switches to `protocol` on request and echoes back whatever it is sent
+func newEchoUpgradeServer(t *testing.T, protocol string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if upgradeType(req.Header) == "" {
+			res.WriteHeader(http.StatusOK)
+			return
+		}
+		conn, brw, err := http.NewResponseController(res).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\nX-Instance: echo\r\n\r\n", protocol)
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Sends an upgrade request for `protocol` to `addr` and returns the
+// connection along with the response
+func dialUpgrade(t *testing.T, addr, protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET /socket HTTP/1.1\r\nHost: lb\r\nConnection: keep-alive, Upgrade\r\nUpgrade: %s\r\n\r\n", protocol)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal("error reading upgrade response: ", err)
+	}
+	return conn, br, resp
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	instance := newEchoUpgradeServer(t, "echo")
+	proxy := newStreamingProxy(t, Config{}, instance.Config.Handler)
+	ins := G_LB.instances[0]
+
+	conn, br, resp := dialUpgrade(t, proxy.Listener.Addr().String(), "echo")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Expected: `101` to `echo`. Actual: `%d` to `%s`\n", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+	if resp.Header.Get("X-Instance") != "echo" {
+		t.Error("headers of the instance's response should be relayed")
+	}
+
+	// Both directions, a few times over
+	for i := range 3 {
+		fmt.Fprintf(conn, "message %d\n", i)
+		line, err := br.ReadString('\n')
+		if err != nil || line != fmt.Sprintf("message %d\n", i) {
+			t.Fatalf("Expected: `message %d`. Actual: `%s` (err: %v)\n", i, line, err)
+		}
+	}
+	if n := ins.upgrades.count(); n != 1 {
+		t.Errorf("Expected 1 upgraded connection. Actual: %d\n", n)
+	}
+	if n := testutil.ToFloat64(UPGRADED_CONNECTIONS_METRIC.WithLabelValues(ins.url)); n != 1 {
+		t.Errorf("Expected upgraded connections metric to be 1. Actual: %v\n", n)
+	}
+
+	conn.Close()
+	for range 100 {
+		if ins.upgrades.count() == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := ins.upgrades.count(); n != 0 {
+		t.Errorf("closed connection should no longer be counted. Actual: %d\n", n)
+	}
+	if n := ins.inFlight.Load(); n != 0 {
+		t.Errorf("closed connection should no longer be in flight. Actual: %d\n", n)
+	}
+}
+
+func TestProxyUpgradeToH2CInstance(t *testing.T) {
+	// Speaks h2c as well as HTTP/1.1, which upgrades need
+	instance := httptest.NewUnstartedServer(newEchoUpgradeServer(t, "echo").Config.Handler)
+	instance.Config.Protocols = &http.Protocols{}
+	instance.Config.Protocols.SetHTTP1(true)
+	instance.Config.Protocols.SetUnencryptedHTTP2(true)
+	instance.Start()
+	defer instance.Close()
+
+	newTestLB(t, Config{}, instance.URL+";proto=h2c")
+	proxy := httptest.NewServer(http.HandlerFunc(proxyHandler))
+	defer proxy.Close()
+
+	conn, br, resp := dialUpgrade(t, proxy.Listener.Addr().String(), "echo")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade to an h2c instance should go over HTTP/1.1. Actual: `%d`\n", resp.StatusCode)
+	}
+	fmt.Fprintln(conn, "hello")
+	if line, err := br.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("Expected: `hello`. Actual: `%s` (err: %v)\n", line, err)
+	}
+
+	// Everything else still goes over h2c
+	before := testutil.ToFloat64(UPSTREAM_PROTOCOL_METRIC.WithLabelValues(instance.URL, "HTTP/2.0"))
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal("request should succeed: ", err)
+	}
+	resp.Body.Close()
+	if n := testutil.ToFloat64(UPSTREAM_PROTOCOL_METRIC.WithLabelValues(instance.URL, "HTTP/2.0")) - before; n != 1 {
+		t.Errorf("Expected 1 request over h2c. Actual: %v\n", n)
+	}
+}
+
+func TestProxyUpgradeUnexpectedProtocol(t *testing.T) {
+	instance := newEchoUpgradeServer(t, "other")
+	proxy := newStreamingProxy(t, Config{}, instance.Config.Handler)
+
+	_, _, resp := dialUpgrade(t, proxy.Listener.Addr().String(), "echo")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected: `502`. Actual: `%d`\n", resp.StatusCode)
+	}
+}
+
+func TestUpgradeType(t *testing.T) {
+	cases := map[string]string{
+		"Upgrade":             "websocket",
+		"keep-alive, upgrade": "websocket",
+		"keep-alive":          "",
+		"":                    "",
+	}
+	for connection, expected := range cases {
+		h := http.Header{"Upgrade": {"websocket"}}
+		if connection != "" {
+			h.Set("Connection", connection)
+		}
+		if actual := upgradeType(h); actual != expected {
+			t.Errorf("`%s` - Expected: `%s`. Actual: `%s`\n", connection, expected, actual)
+		}
+	}
+}
+
+func TestUpgradedConnectionsDrainOnRemoval(t *testing.T) {
+	instance := newEchoUpgradeServer(t, "echo")
+	newTestLB(t, Config{UpgradeDrainTimeout: time.Millisecond * 300}, instance.URL)
+	ins := G_LB.instances[0]
+	proxy := httptest.NewServer(http.HandlerFunc(proxyHandler))
+	defer proxy.Close()
+
+	// One connection finishes while draining, the other is still open at the deadline
+	finishing, _, _ := dialUpgrade(t, proxy.Listener.Addr().String(), "echo")
+	lingering, br, _ := dialUpgrade(t, proxy.Listener.Addr().String(), "echo")
+	fmt.Fprintln(lingering, "hello")
+	br.ReadString('\n')
+
+	removed := time.Now()
+	G_LB.RemoveInstance(instance.URL)
+	time.Sleep(time.Millisecond * 50)
+	fmt.Fprintln(lingering, "still there")
+	if line, err := br.ReadString('\n'); err != nil || line != "still there\n" {
+		t.Errorf("connection should be kept open while draining. Actual: `%s` (err: %v)\n", line, err)
+	}
+	finishing.Close()
+
+	if _, err := br.ReadString('\n'); err != io.EOF {
+		t.Error("connection should be closed once the drain timeout is up. Actual: ", err)
+	}
+	if elapsed := time.Since(removed); elapsed < time.Millisecond*250 {
+		t.Errorf("connection closed before the drain timeout. Elapsed: %s\n", elapsed)
+	}
+
+	// Upgrades that complete after the instance was removed aren't kept
+	if ins.upgrades.add(&splicedConn{done: make(chan struct{})}) {
+		t.Error("draining instance should not take on new connections")
+	}
+}
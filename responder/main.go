@@ -14,6 +14,7 @@ import (
 )
 
 var PORT = flag.Int64("port", 20000, "Provide port to start server on")
+var REQUEST_ID_HEADER = flag.String("request-id-header", "X-Request-ID", "Header the request ID set by lb is read from")
 
 var REQ_COUNT_METRICS = promauto.NewCounter(prometheus.CounterOpts{
 	Name: "count_of_requests",
@@ -26,14 +27,14 @@ func jsonHandler(res http.ResponseWriter, req *http.Request) {
 	REQ_COUNT_METRICS.Inc()
 	bs, err := io.ReadAll(req.Body)
 	if err != nil && err != io.EOF {
-		log.Println("[jsonHandler] -> error reading body: ", err.Error())
+		log.Printf("request_id=%s [jsonHandler] -> error reading body: %s\n", req.Header.Get(*REQUEST_ID_HEADER), err.Error())
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	// Check if correct media header is sent
 	if req.Header.Get("Content-Type") != "application/json" {
-		log.Printf("[jsonHandler] -> incorrect header. Expected: \"application/json\". Received: \"%s\"\n", req.Header.Get("Content-Type"))
+		log.Printf("request_id=%s [jsonHandler] -> incorrect header. Expected: \"application/json\". Received: \"%s\"\n", req.Header.Get(*REQUEST_ID_HEADER), req.Header.Get("Content-Type"))
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -49,7 +50,7 @@ func jsonHandler(res http.ResponseWriter, req *http.Request) {
 	// Check if valid json in case request body is not empty
 	var tempVarForSerialization interface{}
 	if err := json.Unmarshal(bs, &tempVarForSerialization); err != nil {
-		log.Println("[jsonHandler] -> not a valid JSON: ", err.Error())
+		log.Printf("request_id=%s [jsonHandler] -> not a valid JSON: %s\n", req.Header.Get(*REQUEST_ID_HEADER), err.Error())
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -59,6 +60,17 @@ func jsonHandler(res http.ResponseWriter, req *http.Request) {
 	res.Write(bs)
 }
 
+// Logs every request with the ID lb gave it, so that it can be correlated with
+// lb's logs
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if id := req.Header.Get(*REQUEST_ID_HEADER); id != "" {
+			log.Printf("request_id=%s [logRequests] -> %s %s\n", id, req.Method, req.URL.Path)
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
 func router(mux *http.ServeMux) {
 	// GET /health API
 	mux.HandleFunc("GET /health", func(res http.ResponseWriter, req *http.Request) {
@@ -74,8 +86,13 @@ func main() {
 	flag.Parse()
 	mux := http.NewServeMux()
 	router(mux)
+	// Accepts HTTP/2 without TLS as well, so that `lb` can be tried out with
+	// `proto=h2c` instances
+	server := &http.Server{Addr: fmt.Sprintf(":%d", *PORT), Handler: logRequests(mux), Protocols: &http.Protocols{}}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
 	log.Printf("Starting server at ':%d'\n", *PORT)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", *PORT), mux); err != nil {
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatal("[main] -> Error starting http server: ", err)
 	}
 }
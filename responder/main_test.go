@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 )
 
@@ -85,3 +87,29 @@ func TestJsonHandlerMalformedBody(t *testing.T) {
 		t.Errorf("Expected: %d, Actual: %d\n", http.StatusOK, rr.Code)
 	}
 }
+
+func TestLogRequestsRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	req, err := http.NewRequest("POST", "/json", bytes.NewBuffer([]byte(`{"a": "b"`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "abc-123")
+
+	rr := httptest.NewRecorder()
+	logRequests(http.HandlerFunc(jsonHandler)).ServeHTTP(rr, req)
+
+	lines := bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected a request and an error log line. Actual: %q\n", lines)
+	}
+	for _, line := range lines {
+		if !bytes.Contains(line, []byte("request_id=abc-123")) {
+			t.Errorf("log line should carry the request ID. Actual: %s\n", line)
+		}
+	}
+}